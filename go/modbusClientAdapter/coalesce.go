@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sort"
+
+	modbus "github.com/goburrow/modbus"
+)
+
+// readBlock is a single read request that covers the addresses of one or more
+// tags of a device with the same function code
+type readBlock struct {
+	functionCode uint8
+	startAddress uint16
+	addressCount uint16
+	tags         []*pollTag
+}
+
+// end returns the address following the last address read by the block
+func (block *readBlock) end() int {
+	return int(block.startAddress) + int(block.addressCount)
+}
+
+// coalesceTags merges the tags of a device into the fewest block reads. Tags with
+// the same function code are merged when the number of unused addresses between
+// them is at most maxGap and the block remains within the limit of addresses that
+// can be read in a single request. Overlapping tags share a block.
+func coalesceTags(tags []*pollTag, maxGap uint16) []*readBlock {
+	sorted := make([]*pollTag, len(tags))
+	copy(sorted, tags)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if *sorted[i].request.FunctionCode != *sorted[j].request.FunctionCode {
+			return *sorted[i].request.FunctionCode < *sorted[j].request.FunctionCode
+		}
+		return *sorted[i].request.StartAddress < *sorted[j].request.StartAddress
+	})
+
+	var blocks []*readBlock
+	var block *readBlock
+	for _, tag := range sorted {
+		functionCode := *tag.request.FunctionCode
+		start := int(*tag.request.StartAddress)
+		end := start + int(*tag.request.AddressCount)
+
+		if block != nil && block.functionCode == functionCode && start <= block.end()+int(maxGap) &&
+			maxInt(end, block.end())-int(block.startAddress) <= maxBlockAddresses(functionCode) {
+			if end > block.end() {
+				block.addressCount = uint16(end - int(block.startAddress))
+			}
+			block.tags = append(block.tags, tag)
+			continue
+		}
+
+		block = &readBlock{
+			functionCode: functionCode,
+			startAddress: uint16(start),
+			addressCount: uint16(end - start),
+			tags:         []*pollTag{tag},
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// maxBlockAddresses returns the number of addresses that can be read by a single
+// request with the function code
+func maxBlockAddresses(functionCode uint8) int {
+	if functionCode == modbus.FuncCodeReadCoils || functionCode == modbus.FuncCodeReadDiscreteInputs {
+		return maxReadCoils
+	}
+	return maxReadRegisters
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// blockRequest returns the request that reads a block from a device
+func blockRequest(device *pollDevice, block *readBlock) *modbusRequest {
+	functionCode := block.functionCode
+	startAddress := block.startAddress
+	addressCount := block.addressCount
+	return &modbusRequest{
+		ModbusHost:   device.host,
+		UnitID:       device.unitID,
+		FunctionCode: &functionCode,
+		StartAddress: &startAddress,
+		AddressCount: &addressCount,
+	}
+}
+
+// tagData returns the Data of a tag from the data read for the block containing
+// it, decoded and scaled as specified by the tag
+func tagData(block *readBlock, data interface{}, tag *pollTag) (interface{}, error) {
+	offset := int(*tag.request.StartAddress) - int(block.startAddress)
+	count := int(*tag.request.AddressCount)
+
+	switch values := data.(type) {
+	case []bool:
+		if offset+count > len(values) {
+			return nil, fmt.Errorf("modbus: response does not contain the coils of tag %s", tag.name)
+		}
+		return values[offset : offset+count], nil
+	case []uint16:
+		if offset+count > len(values) {
+			return nil, fmt.Errorf("modbus: response does not contain the registers of tag %s", tag.name)
+		}
+		modbusBytes := make([]byte, count*2)
+		for ndx, register := range values[offset : offset+count] {
+			binary.BigEndian.PutUint16(modbusBytes[ndx*2:], register)
+		}
+		return registerData(tag.request, modbusBytes)
+	}
+	log.Printf("[ERROR] tagData - Unexpected data read for block: %#v\n", data)
+	return nil, fmt.Errorf("modbus: unexpected data read for tag %s", tag.name)
+}
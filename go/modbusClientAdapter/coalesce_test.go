@@ -0,0 +1,155 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newPollTag(name string, functionCode uint8, startAddress uint16, addressCount uint16) *pollTag {
+	return &pollTag{name: name, request: &modbusRequest{FunctionCode: &functionCode, StartAddress: &startAddress, AddressCount: &addressCount}}
+}
+
+// blockLayout describes a block by its function code, addresses and the names of
+// its tags
+type blockLayout struct {
+	functionCode uint8
+	startAddress uint16
+	addressCount uint16
+	tags         []string
+}
+
+func layout(blocks []*readBlock) []blockLayout {
+	layouts := make([]blockLayout, len(blocks))
+	for ndx, block := range blocks {
+		layouts[ndx] = blockLayout{block.functionCode, block.startAddress, block.addressCount, nil}
+		for _, tag := range block.tags {
+			layouts[ndx].tags = append(layouts[ndx].tags, tag.name)
+		}
+	}
+	return layouts
+}
+
+func TestCoalesceTags(t *testing.T) {
+	tests := []struct {
+		name   string
+		tags   []*pollTag
+		maxGap uint16
+		want   []blockLayout
+	}{
+		{
+			name: "adjacent",
+			tags: []*pollTag{newPollTag("a", 3, 100, 2), newPollTag("b", 3, 102, 1)},
+			want: []blockLayout{{3, 100, 3, []string{"a", "b"}}},
+		},
+		{
+			name: "sorted by address",
+			tags: []*pollTag{newPollTag("b", 3, 102, 1), newPollTag("a", 3, 100, 2)},
+			want: []blockLayout{{3, 100, 3, []string{"a", "b"}}},
+		},
+		{
+			name: "overlapping",
+			tags: []*pollTag{newPollTag("a", 3, 100, 4), newPollTag("b", 3, 101, 1), newPollTag("c", 3, 102, 4)},
+			want: []blockLayout{{3, 100, 6, []string{"a", "b", "c"}}},
+		},
+		{
+			name: "gap larger than MaxGap",
+			tags: []*pollTag{newPollTag("a", 3, 100, 2), newPollTag("b", 3, 105, 1)},
+			want: []blockLayout{{3, 100, 2, []string{"a"}}, {3, 105, 1, []string{"b"}}},
+		},
+		{
+			name:   "gap within MaxGap",
+			tags:   []*pollTag{newPollTag("a", 3, 100, 2), newPollTag("b", 3, 105, 1)},
+			maxGap: 3,
+			want:   []blockLayout{{3, 100, 6, []string{"a", "b"}}},
+		},
+		{
+			name: "function codes are not merged",
+			tags: []*pollTag{newPollTag("a", 4, 101, 1), newPollTag("b", 3, 100, 1), newPollTag("c", 1, 0, 1)},
+			want: []blockLayout{{1, 0, 1, []string{"c"}}, {3, 100, 1, []string{"b"}}, {4, 101, 1, []string{"a"}}},
+		},
+		{
+			name: "register limit",
+			tags: []*pollTag{newPollTag("a", 3, 0, 100), newPollTag("b", 3, 100, 25), newPollTag("c", 3, 125, 1)},
+			want: []blockLayout{{3, 0, 125, []string{"a", "b"}}, {3, 125, 1, []string{"c"}}},
+		},
+		{
+			name: "coil limit",
+			tags: []*pollTag{newPollTag("a", 1, 0, 1000), newPollTag("b", 1, 1000, 1000), newPollTag("c", 1, 2000, 1)},
+			want: []blockLayout{{1, 0, 2000, []string{"a", "b"}}, {1, 2000, 1, []string{"c"}}},
+		},
+		{
+			name: "end of the address space",
+			tags: []*pollTag{newPollTag("a", 3, 65530, 4), newPollTag("b", 3, 65534, 2)},
+			want: []blockLayout{{3, 65530, 6, []string{"a", "b"}}},
+		},
+		{
+			name: "no tags",
+			want: []blockLayout{},
+		},
+	}
+
+	for _, test := range tests {
+		if got := layout(coalesceTags(test.tags, test.maxGap)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: coalesceTags = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCoalesceTagsKeepsConfiguredTags(t *testing.T) {
+	tags := []*pollTag{newPollTag("b", 3, 102, 1), newPollTag("a", 3, 100, 2)}
+	coalesceTags(tags, 0)
+	if tags[0].name != "b" || tags[1].name != "a" {
+		t.Errorf("coalesceTags reordered the tags of the device: %s, %s", tags[0].name, tags[1].name)
+	}
+}
+
+func TestBlockRequest(t *testing.T) {
+	unitID := uint8(7)
+	device := &pollDevice{host: "192.168.0.9:502", unitID: &unitID}
+	block := &readBlock{functionCode: 4, startAddress: 100, addressCount: 6}
+
+	request := blockRequest(device, block)
+	if request.ModbusHost != device.host || request.UnitID != &unitID || *request.FunctionCode != 4 ||
+		*request.StartAddress != 100 || *request.AddressCount != 6 {
+		t.Errorf("blockRequest = %+v", request)
+	}
+	if err := validateRequest(request); err != nil {
+		t.Errorf("blockRequest is not valid: %s", err)
+	}
+}
+
+func TestTagData(t *testing.T) {
+	coils := &readBlock{functionCode: 1, startAddress: 10, addressCount: 4}
+	registers := &readBlock{functionCode: 3, startAddress: 100, addressCount: 4}
+	float32Tag := newPollTag("temperature", 3, 102, 2)
+	float32Tag.request.DataType = "float32"
+
+	tests := []struct {
+		name  string
+		block *readBlock
+		data  interface{}
+		tag   *pollTag
+		want  interface{}
+		err   string
+	}{
+		{"coils", coils, []bool{true, false, true, true}, newPollTag("valve", 1, 11, 2), []bool{false, true}, ""},
+		{"registers", registers, []uint16{1, 2, 3, 4}, newPollTag("level", 3, 101, 2), []uint16{2, 3}, ""},
+		{"typed registers", registers, []uint16{0, 0, 0x41C8, 0x0000}, float32Tag, []interface{}{25.0}, ""},
+		{"short coils", coils, []bool{true}, newPollTag("valve", 1, 11, 2), nil, "modbus: response does not contain the coils of tag valve"},
+		{"short registers", registers, []uint16{1, 2}, newPollTag("level", 3, 101, 2), nil, "modbus: response does not contain the registers of tag level"},
+		{"unexpected data", registers, "0102", newPollTag("level", 3, 101, 2), nil, "modbus: unexpected data read for tag level"},
+	}
+
+	for _, test := range tests {
+		got, err := tagData(test.block, test.data, test.tag)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: tagData error = %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: tagData = %#v, %v, want %#v", test.name, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	modbus "github.com/goburrow/modbus"
+)
+
+const (
+	funcCodeReadExceptionStatus = 7
+	funcCodeDiagnostics         = 8
+	funcCodeReportServerID      = 17
+
+	diagReturnQueryData          = 0x00
+	diagRestartCommunications    = 0x01
+	diagReturnDiagnosticRegister = 0x02
+	diagChangeASCIIDelimiter     = 0x03
+	diagForceListenOnly          = 0x04
+	diagClearCounters            = 0x0A
+	diagBusMessageCount          = 0x0B
+	diagBusCommunicationErrors   = 0x0C
+	diagBusExceptionErrors       = 0x0D
+	diagServerMessageCount       = 0x0E
+	diagServerNoResponseCount    = 0x0F
+	diagServerNAKCount           = 0x10
+	diagServerBusyCount          = 0x11
+	diagBusCharacterOverrunCount = 0x12
+	diagClearOverrunCounter      = 0x14
+)
+
+// diagnosticsSubFunctionNames are the names of the supported diagnostics
+// sub-functions, as returned in responses
+var diagnosticsSubFunctionNames = map[uint16]string{
+	diagReturnQueryData:          "ReturnQueryData",
+	diagRestartCommunications:    "RestartCommunicationsOption",
+	diagReturnDiagnosticRegister: "DiagnosticRegister",
+	diagChangeASCIIDelimiter:     "ChangeASCIIInputDelimiter",
+	diagClearCounters:            "ClearCountersAndDiagnosticRegister",
+	diagBusMessageCount:          "BusMessageCount",
+	diagBusCommunicationErrors:   "BusCommunicationErrorCount",
+	diagBusExceptionErrors:       "BusExceptionErrorCount",
+	diagServerMessageCount:       "ServerMessageCount",
+	diagServerNoResponseCount:    "ServerNoResponseCount",
+	diagServerNAKCount:           "ServerNAKCount",
+	diagServerBusyCount:          "ServerBusyCount",
+	diagBusCharacterOverrunCount: "BusCharacterOverrunCount",
+	diagClearOverrunCounter:      "ClearOverrunCounterAndFlag",
+}
+
+// isDiagnosticsSubFunction returns true if the diagnostics sub-function can be
+// issued by the adapter. Force Listen Only Mode is excluded since the device
+// does not respond to it and can only be recovered with a restart.
+func isDiagnosticsSubFunction(subFunction uint16) bool {
+	_, ok := diagnosticsSubFunctionNames[subFunction]
+	return ok
+}
+
+// readExceptionStatus reads the eight exception status outputs of a serial device
+//
+// Request:
+//
+//	Function code         : 1 byte (0x07)
+//
+// Response:
+//
+//	Function code         : 1 byte (0x07)
+//	Output data           : 1 byte
+func readExceptionStatus(handler modbusClientHandler) (map[string]interface{}, error) {
+	response, err := sendPDU(handler, &modbus.ProtocolDataUnit{FunctionCode: funcCodeReadExceptionStatus})
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Data) != 1 {
+		return nil, fmt.Errorf("modbus: response data size '%v' does not match expected '%v'", len(response.Data), 1)
+	}
+
+	return map[string]interface{}{
+		"Status": response.Data[0],
+		"Bits":   translateModbusBytesToData(response.Data, 8),
+	}, nil
+}
+
+// diagnostics issues a diagnostics sub-function and returns the decoded result
+//
+// Request:
+//
+//	Function code         : 1 byte (0x08)
+//	Sub-function          : 2 bytes
+//	Data                  : 2 bytes
+//
+// Response:
+//
+//	Function code         : 1 byte (0x08)
+//	Sub-function          : 2 bytes
+//	Data                  : 2 bytes
+func diagnostics(handler modbusClientHandler, subFunction uint16, value uint16) (map[string]interface{}, error) {
+	request := &modbus.ProtocolDataUnit{
+		FunctionCode: funcCodeDiagnostics,
+		Data:         []byte{byte(subFunction >> 8), byte(subFunction), byte(value >> 8), byte(value)},
+	}
+	response, err := sendPDU(handler, request)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Data) != 4 {
+		return nil, fmt.Errorf("modbus: response data size '%v' does not match expected '%v'", len(response.Data), 4)
+	}
+	if respSubFunction := binary.BigEndian.Uint16(response.Data); respSubFunction != subFunction {
+		return nil, fmt.Errorf("modbus: response sub-function '%v' does not match request '%v'", respSubFunction, subFunction)
+	}
+
+	result := map[string]interface{}{
+		"SubFunction": subFunction,
+		"Name":        diagnosticsSubFunctionNames[subFunction],
+	}
+	respValue := binary.BigEndian.Uint16(response.Data[2:])
+
+	switch subFunction {
+	case diagReturnDiagnosticRegister:
+		result["Value"] = respValue
+		result["Bits"] = translateModbusBytesToData([]byte{byte(respValue), byte(respValue >> 8)}, 16)
+	case diagBusMessageCount, diagBusCommunicationErrors, diagBusExceptionErrors,
+		diagServerMessageCount, diagServerNoResponseCount, diagServerNAKCount,
+		diagServerBusyCount, diagBusCharacterOverrunCount:
+		result["Counter"] = respValue
+	default:
+		//Sub-functions that echo the request data
+		result["Value"] = respValue
+	}
+
+	return result, nil
+}
+
+// reportServerID reads the server id, run indicator status and any additional
+// device specific data. The server id is assumed to be a single byte, as it is
+// for the majority of devices; the complete response is also returned as hex so
+// that device specific layouts can be decoded by the client.
+//
+// Request:
+//
+//	Function code         : 1 byte (0x11)
+//
+// Response:
+//
+//	Function code         : 1 byte (0x11)
+//	Byte count            : 1 byte
+//	Server id             : device specific
+//	Run indicator status  : 1 byte (0x00 = OFF, 0xFF = ON)
+//	Additional data       : device specific
+func reportServerID(handler modbusClientHandler) (map[string]interface{}, error) {
+	response, err := sendPDU(handler, &modbus.ProtocolDataUnit{FunctionCode: funcCodeReportServerID})
+	if err != nil {
+		return nil, err
+	}
+
+	byteCount := int(response.Data[0])
+	if byteCount != len(response.Data)-1 {
+		return nil, fmt.Errorf("modbus: response data size '%v' does not match count '%v'", len(response.Data)-1, byteCount)
+	}
+	if byteCount < 2 {
+		return nil, fmt.Errorf("modbus: response data size '%v' is less than expected '%v'", byteCount, 2)
+	}
+
+	data := response.Data[1:]
+	return map[string]interface{}{
+		"ServerID":       data[0],
+		"RunIndicator":   data[1] == 0xFF,
+		"AdditionalData": hex.EncodeToString(data[2:]),
+		"Raw":            hex.EncodeToString(data),
+	}, nil
+}
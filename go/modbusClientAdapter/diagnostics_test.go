@@ -0,0 +1,152 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// byteFrames splits a frame into single bytes, as they may arrive from a slow
+// serial line
+func byteFrames(frame []byte) [][]byte {
+	frames := make([][]byte, len(frame))
+	for ndx := range frame {
+		frames[ndx] = frame[ndx : ndx+1]
+	}
+	return frames
+}
+
+func TestDiagnosticsOverSerialRTU(t *testing.T) {
+	handler := newRTULoopback(t, func(request []byte) [][]byte {
+		subFunction := uint16(request[2])<<8 | uint16(request[3])
+		switch subFunction {
+		case diagReturnQueryData:
+			return byteFrames(rtuFrame(t, funcCodeDiagnostics, request[2:6]))
+		case diagBusMessageCount:
+			return byteFrames(rtuFrame(t, funcCodeDiagnostics, []byte{0, diagBusMessageCount, 0x01, 0x2C}))
+		case diagReturnDiagnosticRegister:
+			return byteFrames(rtuFrame(t, funcCodeDiagnostics, []byte{0, diagReturnDiagnosticRegister, 0x00, 0x05}))
+		}
+		return [][]byte{rtuFrame(t, funcCodeDiagnostics|0x80, []byte{1})}
+	})
+
+	tests := []struct {
+		subFunction uint16
+		value       uint16
+		want        map[string]interface{}
+	}{
+		{diagReturnQueryData, 0xA537, map[string]interface{}{"SubFunction": uint16(0), "Name": "ReturnQueryData", "Value": uint16(0xA537)}},
+		{diagBusMessageCount, 0, map[string]interface{}{"SubFunction": uint16(0x0B), "Name": "BusMessageCount", "Counter": uint16(300)}},
+		{diagReturnDiagnosticRegister, 0, map[string]interface{}{
+			"SubFunction": uint16(2),
+			"Name":        "DiagnosticRegister",
+			"Value":       uint16(5),
+			"Bits":        []bool{true, false, true, false, false, false, false, false, false, false, false, false, false, false, false, false},
+		}},
+	}
+
+	for _, test := range tests {
+		got, err := diagnostics(handler, test.subFunction, test.value)
+		if err != nil {
+			t.Errorf("diagnostics(%#x) returned error: %s", test.subFunction, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("diagnostics(%#x) = %v, want %v", test.subFunction, got, test.want)
+		}
+	}
+
+	if _, err := diagnostics(handler, diagClearCounters, 0); err == nil || err.Error() != "modbus: exception '1' (illegal function), function '136'" {
+		t.Errorf("diagnostics of an unsupported sub-function error = %v", err)
+	}
+}
+
+func TestReportServerIDOverSerialRTU(t *testing.T) {
+	handler := newRTULoopback(t, func(request []byte) [][]byte {
+		//Server id, run indicator and 3 bytes of additional data
+		return byteFrames(rtuFrame(t, funcCodeReportServerID, []byte{5, 0x2A, 0xFF, 'a', 'b', 'c'}))
+	})
+
+	got, err := reportServerID(handler)
+	if err != nil {
+		t.Fatalf("reportServerID returned error: %s", err)
+	}
+	want := map[string]interface{}{
+		"ServerID":       byte(0x2A),
+		"RunIndicator":   true,
+		"AdditionalData": "616263",
+		"Raw":            "2aff616263",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("reportServerID = %v, want %v", got, want)
+	}
+}
+
+func TestReadExceptionStatusOverSerialRTU(t *testing.T) {
+	handler := newRTULoopback(t, func(request []byte) [][]byte {
+		return byteFrames(rtuFrame(t, funcCodeReadExceptionStatus, []byte{0x81}))
+	})
+
+	got, err := readExceptionStatus(handler)
+	if err != nil {
+		t.Fatalf("readExceptionStatus returned error: %s", err)
+	}
+	want := map[string]interface{}{
+		"Status": byte(0x81),
+		"Bits":   []bool{true, false, false, false, false, false, false, true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readExceptionStatus = %v, want %v", got, want)
+	}
+}
+
+func TestRTUResponseLength(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"too short", []byte{1, 3}, 0},
+		{"exception", []byte{1, 0x83, 2}, 5},
+		{"read holding registers", []byte{1, 3, 4}, 9},
+		{"read coils", []byte{1, 1, 1}, 6},
+		{"write single register", []byte{1, 6, 0}, 8},
+		{"read exception status", []byte{1, 7, 0x81}, 5},
+		{"diagnostics", []byte{1, 8, 0}, 8},
+		{"report server id", []byte{1, 17, 5}, 10},
+		{"read file record", []byte{1, 20, 8}, 13},
+		{"write file record", []byte{1, 21, 9}, 14},
+		{"mask write register", []byte{1, 22, 0}, 10},
+		{"read fifo queue without count", []byte{1, 24, 0}, 0},
+		{"read fifo queue", []byte{1, 24, 0, 6}, 12},
+		{"device id without object count", []byte{1, 43, 0x0E, 1, 1, 0, 0}, 0},
+		{"device id without objects", []byte{1, 43, 0x0E, 1, 1, 0, 0, 0}, 10},
+		{"device id with partial objects", []byte{1, 43, 0x0E, 1, 1, 0, 0, 2, 0, 3, 'a', 'b', 'c'}, 0},
+		{"device id", []byte{1, 43, 0x0E, 1, 1, 0, 0, 2, 0, 3, 'a', 'b', 'c', 1, 2}, 19},
+		{"other encapsulated interface", []byte{1, 43, 0x0D, 0}, 0},
+		{"vendor specific", []byte{1, 65, 0}, 0},
+	}
+
+	for _, test := range tests {
+		if got := rtuResponseLength(test.data); got != test.want {
+			t.Errorf("rtuResponseLength(%s) = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReadDeviceIdentificationOverSerialRTU(t *testing.T) {
+	handler := newRTULoopback(t, func(request []byte) [][]byte {
+		return byteFrames(rtuFrame(t, funcCodeEncapsulatedInterface, []byte{
+			meiTypeReadDeviceID, readDeviceIDBasic, 0x01, 0x00, 0x00, 2,
+			0x00, 4, 'A', 'c', 'm', 'e',
+			0x01, 3, 'X', '1', '0',
+		}))
+	})
+
+	objects, conformityLevel, err := readDeviceIdentification(handler, readDeviceIDBasic, 0)
+	if err != nil {
+		t.Fatalf("readDeviceIdentification returned error: %s", err)
+	}
+	if want := map[string]string{"VendorName": "Acme", "ProductCode": "X10"}; !reflect.DeepEqual(objects, want) || conformityLevel != 1 {
+		t.Errorf("readDeviceIdentification = %v, %d", objects, conformityLevel)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	hostQueueSize         = 100
+	hostWorkerIdleTimeout = 60 * time.Second
+)
+
+// requestDispatcher fans incoming requests out to one worker goroutine per modbus
+// host. Requests for the same host are processed in the order they were received,
+// while a slow or unreachable host only delays its own requests. The number of
+// requests being processed at once is bounded by the number of slots.
+//
+// Each queued job is a function that processes a request, so that polled reads
+// share the worker of their modbus host with the requests received over MQTT.
+type requestDispatcher struct {
+	mu          sync.Mutex
+	queues      map[string]chan func()
+	slots       chan struct{}
+	stopped     chan struct{}
+	workers     sync.WaitGroup
+	idleTimeout time.Duration
+	handler     func([]byte)
+	reject      func(payload []byte, errMsg string)
+}
+
+func newRequestDispatcher(maxConcurrent int, handler func([]byte)) *requestDispatcher {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	return &requestDispatcher{
+		queues:      make(map[string]chan func()),
+		slots:       make(chan struct{}, maxConcurrent),
+		stopped:     make(chan struct{}),
+		idleTimeout: hostWorkerIdleTimeout,
+		handler:     handler,
+		reject:      rejectRequest,
+	}
+}
+
+// dispatch queues the request on the worker for its modbus host. Requests are
+// rejected when the queue for the host is full.
+func (d *requestDispatcher) dispatch(payload []byte) {
+	host := requestHost(payload)
+
+	if !d.enqueue(host, func() { handleRequestSafely(d.handler, payload) }) {
+		log.Printf("[ERROR] requestDispatcher.dispatch - Request queue for modbus host %s is full\n", host)
+		d.reject(payload, "Request queue for modbus host is full")
+	}
+}
+
+// enqueue queues a job on the worker for a modbus host, starting the worker if
+// necessary. False is returned when the queue for the host is full.
+func (d *requestDispatcher) enqueue(host string, job func()) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	queue, ok := d.queues[host]
+	if !ok {
+		log.Printf("[DEBUG] requestDispatcher.enqueue - Starting worker for modbus host %s\n", host)
+		queue = make(chan func(), hostQueueSize)
+		d.queues[host] = queue
+		d.workers.Add(1)
+		go d.worker(host, queue)
+	}
+
+	select {
+	case queue <- job:
+		log.Printf("[DEBUG] requestDispatcher.enqueue - %d request(s) queued for modbus host %s\n", len(queue), host)
+		return true
+	default:
+		return false
+	}
+}
+
+// worker processes the requests for a single modbus host until the dispatcher is
+// stopped or the host has been idle for the idle timeout of the dispatcher
+func (d *requestDispatcher) worker(host string, queue chan func()) {
+	defer d.workers.Done()
+
+	idleTimer := time.NewTimer(d.idleTimeout)
+	defer idleTimer.Stop()
+
+	for {
+		select {
+		case job := <-queue:
+			select {
+			case d.slots <- struct{}{}:
+			case <-d.stopped:
+				return
+			}
+			job()
+			<-d.slots
+
+			if !idleTimer.Stop() {
+				<-idleTimer.C
+			}
+			idleTimer.Reset(d.idleTimeout)
+		case <-idleTimer.C:
+			d.mu.Lock()
+			if len(queue) > 0 {
+				//A request arrived while the timer fired, keep working
+				d.mu.Unlock()
+				idleTimer.Reset(d.idleTimeout)
+				continue
+			}
+			log.Printf("[DEBUG] requestDispatcher.worker - Stopping idle worker for modbus host %s\n", host)
+			delete(d.queues, host)
+			d.mu.Unlock()
+			return
+		case <-d.stopped:
+			return
+		}
+	}
+}
+
+// queueDepth returns the number of requests waiting for each modbus host
+func (d *requestDispatcher) queueDepth() map[string]int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	depth := make(map[string]int, len(d.queues))
+	for host, queue := range d.queues {
+		depth[host] = len(queue)
+	}
+	return depth
+}
+
+// stop stops all workers and waits for any in-flight requests to complete.
+// Queued requests that have not started are discarded.
+func (d *requestDispatcher) stop() {
+	close(d.stopped)
+	d.workers.Wait()
+}
+
+// requestHost extracts the ModbusHost from a request so that it can be routed
+// to a worker, which is keyed by the connection the host uses. Malformed requests
+// are routed to the "" worker, where handleRequest will report the error.
+func requestHost(payload []byte) string {
+	var request struct {
+		ModbusHost interface{}
+	}
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return ""
+	}
+	if host, ok := request.ModbusHost.(string); ok {
+		return modbusHostKey(host)
+	}
+	return ""
+}
+
+// rejectRequest publishes an error response for a request that could not be processed
+func rejectRequest(payload []byte, errMsg string) {
+	//The request is echoed on a best effort basis, it has not been validated yet
+	request := &modbusRequest{}
+	json.Unmarshal(payload, request)
+
+	response := newModbusResponse(request)
+	addErrorToResponse(response, errMsg, 0)
+	response.Request = payload
+	publishModbusResponse(response)
+}
+
+// publishQueueDepth logs the depth of the request queues and publishes them, along
+// with the number of requests and poll cycles that have panicked and the number of
+// messages stored in the outbox, to the {topicRoot}/status topic
+func publishQueueDepth(d *requestDispatcher) {
+	depth := d.queueDepth()
+
+	total := 0
+	for _, count := range depth {
+		total += count
+	}
+	log.Printf("[INFO] publishQueueDepth - %d request(s) queued across %d modbus host(s)\n", total, len(depth))
+
+	status := map[string]interface{}{
+		"QueueDepth":     total,
+		"HostQueueDepth": depth,
+		"PanicCount":     atomic.LoadUint64(&requestPanics),
+		"timestamp":      time.Now().Format(JavascriptISOString),
+	}
+	if adapterID != "" {
+		status["SiteID"] = adapterID
+	}
+	if outbox != nil {
+		status["StoredMessages"] = outbox.pending()
+		status["DroppedMessages"] = atomic.LoadUint64(&outbox.dropped)
+	}
+
+	statusStr, err := json.Marshal(status)
+	if err != nil {
+		log.Printf("[ERROR] publishQueueDepth - ERROR marshalling json status: %s\n", err.Error())
+		return
+	}
+	if err = publish(topicRoot+"/status", string(statusStr)); err != nil {
+		log.Printf("[ERROR] publishQueueDepth - ERROR publishing to topic: %s\n", err.Error())
+	}
+}
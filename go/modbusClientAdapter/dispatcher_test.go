@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor waits for the wait group, failing the test if it takes too long
+func waitFor(t *testing.T, wg *sync.WaitGroup, what string) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func TestDispatcherOrdersRequestsPerHost(t *testing.T) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	processed := map[string][]int{}
+
+	d := newRequestDispatcher(2, func(payload []byte) {
+		defer wg.Done()
+		var request struct {
+			ModbusHost string
+			Sequence   int
+		}
+		json.Unmarshal(payload, &request)
+		if request.ModbusHost == "192.168.0.9:502" {
+			//A slow host does not reorder its own requests
+			time.Sleep(time.Millisecond)
+		}
+		mu.Lock()
+		processed[request.ModbusHost] = append(processed[request.ModbusHost], request.Sequence)
+		mu.Unlock()
+	})
+	defer d.stop()
+
+	hosts := []string{"192.168.0.9:502", "192.168.0.10:502", "rtu:///dev/ttyUSB0"}
+	want := []int{}
+	for sequence := 0; sequence < 20; sequence++ {
+		want = append(want, sequence)
+		for _, host := range hosts {
+			wg.Add(1)
+			d.dispatch([]byte(fmt.Sprintf(`{"ModbusHost":%q,"Sequence":%d}`, host, sequence)))
+		}
+	}
+	waitFor(t, &wg, "the requests to be processed")
+
+	for _, host := range hosts {
+		if !reflect.DeepEqual(processed[host], want) {
+			t.Errorf("requests for %s were processed in the order %v", host, processed[host])
+		}
+	}
+}
+
+func TestDispatcherBoundsConcurrentRequests(t *testing.T) {
+	const maxConcurrent = 2
+	var active, maxActive int32
+	var wg sync.WaitGroup
+	release := make(chan struct{})
+
+	d := newRequestDispatcher(maxConcurrent, nil)
+	defer d.stop()
+
+	for ndx := 0; ndx < 5; ndx++ {
+		wg.Add(1)
+		d.enqueue(fmt.Sprintf("192.168.0.%d:502", ndx), func() {
+			defer wg.Done()
+			count := atomic.AddInt32(&active, 1)
+			for {
+				max := atomic.LoadInt32(&maxActive)
+				if count <= max || atomic.CompareAndSwapInt32(&maxActive, max, count) {
+					break
+				}
+			}
+			<-release
+			atomic.AddInt32(&active, -1)
+		})
+	}
+
+	//The other workers wait for a slot while the first requests are in flight
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&active) < maxConcurrent && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if count := atomic.LoadInt32(&active); count != maxConcurrent {
+		t.Errorf("%d request(s) in flight, want %d", count, maxConcurrent)
+	}
+
+	close(release)
+	waitFor(t, &wg, "the requests to be processed")
+	if max := atomic.LoadInt32(&maxActive); max != maxConcurrent {
+		t.Errorf("at most %d request(s) were in flight, want %d", max, maxConcurrent)
+	}
+}
+
+func TestDispatcherRejectsRequestsWhenQueueIsFull(t *testing.T) {
+	var wg sync.WaitGroup
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	d := newRequestDispatcher(1, func(payload []byte) {
+		defer wg.Done()
+		if string(payload) == `{"ModbusHost":"192.168.0.9:502","Sequence":0}` {
+			close(started)
+			<-release
+		}
+	})
+	var rejected []string
+	d.reject = func(payload []byte, errMsg string) {
+		rejected = append(rejected, string(payload))
+	}
+	defer d.stop()
+
+	//The first request is in flight, the next ones fill the queue
+	request := func(sequence int) []byte {
+		return []byte(fmt.Sprintf(`{"ModbusHost":"192.168.0.9:502","Sequence":%d}`, sequence))
+	}
+	wg.Add(1)
+	d.dispatch(request(0))
+	<-started
+	for sequence := 1; sequence <= hostQueueSize; sequence++ {
+		wg.Add(1)
+		d.dispatch(request(sequence))
+	}
+	if len(rejected) != 0 {
+		t.Fatalf("%d request(s) rejected before the queue was full", len(rejected))
+	}
+
+	d.dispatch(request(hostQueueSize + 1))
+	if want := []string{string(request(hostQueueSize + 1))}; !reflect.DeepEqual(rejected, want) {
+		t.Errorf("rejected requests = %v, want %v", rejected, want)
+	}
+	if depth := d.queueDepth()["192.168.0.9:502"]; depth != hostQueueSize {
+		t.Errorf("queue depth = %d, want %d", depth, hostQueueSize)
+	}
+
+	//Other hosts are not affected by the full queue
+	wg.Add(1)
+	d.dispatch([]byte(`{"ModbusHost":"192.168.0.10:502"}`))
+	if len(rejected) != 1 {
+		t.Errorf("a request for another host was rejected")
+	}
+
+	close(release)
+	waitFor(t, &wg, "the queued requests to be processed")
+}
+
+func TestDispatcherStopsIdleWorkers(t *testing.T) {
+	var processed int32
+	var wg sync.WaitGroup
+
+	d := newRequestDispatcher(4, nil)
+	d.idleTimeout = time.Millisecond
+	defer d.stop()
+
+	//Requests arrive as the worker for the host times out. Each one must be
+	//processed, by the worker that is stopping or by a new one.
+	for ndx := 0; ndx < 500; ndx++ {
+		wg.Add(1)
+		if !d.enqueue("192.168.0.9:502", func() {
+			atomic.AddInt32(&processed, 1)
+			wg.Done()
+		}) {
+			t.Fatal("enqueue rejected a request")
+		}
+		time.Sleep(time.Duration(ndx%3) * time.Millisecond)
+	}
+	waitFor(t, &wg, "the requests to be processed")
+	if count := atomic.LoadInt32(&processed); count != 500 {
+		t.Errorf("%d request(s) processed, want 500", count)
+	}
+
+	//The worker is stopped once the host is idle
+	deadline := time.Now().Add(5 * time.Second)
+	for len(d.queueDepth()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if depth := d.queueDepth(); len(depth) != 0 {
+		t.Errorf("workers still running for idle hosts: %v", depth)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	modbus "github.com/goburrow/modbus"
+)
+
+const (
+	funcCodeReadFileRecord  = 20
+	funcCodeWriteFileRecord = 21
+
+	fileRecordReferenceType = 6
+	fileRecordMaxNumber     = 0x270F
+	//The byte count of the request and response must fit in the 253 byte PDU
+	fileRecordMaxByteCount = 0xF5
+)
+
+// fileRecord is a single file record sub-request
+type fileRecord struct {
+	FileNumber   uint16   `json:"FileNumber"`
+	RecordNumber uint16   `json:"RecordNumber"`
+	RecordLength uint16   `json:"RecordLength"`
+	Data         []uint16 `json:"Data,omitempty"`
+}
+
+// validateFileRecords validates the FileRecords of a file record request. Record
+// data is required for writes, and the RecordLength of written records defaults
+// to the number of registers in their data.
+func validateFileRecords(records []fileRecord, write bool) error {
+	if len(records) == 0 {
+		return fmt.Errorf("FileRecords must be an array containing at least one file record")
+	}
+
+	//The byte counts of the request and of the response, which must both fit
+	requestByteCount, responseByteCount := 0, 0
+	for ndx := range records {
+		record := &records[ndx]
+		if record.FileNumber < 1 {
+			return fmt.Errorf("FileRecords[%d].FileNumber must be an integer between 1 and 65535", ndx)
+		}
+		if record.RecordNumber > fileRecordMaxNumber {
+			return fmt.Errorf("FileRecords[%d].RecordNumber must be an integer between 0 and %d", ndx, fileRecordMaxNumber)
+		}
+
+		if write {
+			if len(record.Data) == 0 {
+				return fmt.Errorf("FileRecords[%d].Data is required for function code %d", ndx, funcCodeWriteFileRecord)
+			}
+			if record.RecordLength != 0 && int(record.RecordLength) != len(record.Data) {
+				return fmt.Errorf("FileRecords[%d].RecordLength must match the number of Data values", ndx)
+			}
+			record.RecordLength = uint16(len(record.Data))
+			//Each sub-request is 7 bytes and the record data, and is echoed in the response
+			requestByteCount += 7 + len(record.Data)*2
+			responseByteCount += 7 + len(record.Data)*2
+		} else {
+			if record.RecordLength < 1 || record.RecordLength > fileRecordMaxByteCount/2 {
+				return fmt.Errorf("FileRecords[%d].RecordLength must be an integer between 1 and %d", ndx, fileRecordMaxByteCount/2)
+			}
+			//Each sub-request is 7 bytes, and each sub-response is a length byte, the
+			//reference type and the record data
+			requestByteCount += 7
+			responseByteCount += 2 + int(record.RecordLength)*2
+		}
+	}
+
+	if requestByteCount > fileRecordMaxByteCount || responseByteCount > fileRecordMaxByteCount {
+		return fmt.Errorf("FileRecords exceed the maximum modbus message size")
+	}
+	return nil
+}
+
+// readFileRecords reads the file records and returns the records with their data
+//
+// Request:
+//
+//	Function code         : 1 byte (0x14)
+//	Byte count            : 1 byte
+//	Sub-requests          : reference type (1 byte), file number (2 bytes),
+//	                        record number (2 bytes), record length (2 bytes)
+//
+// Response:
+//
+//	Function code         : 1 byte (0x14)
+//	Response data length  : 1 byte
+//	Sub-responses         : length (1 byte), reference type (1 byte), record data (Nx2 bytes)
+func readFileRecords(handler modbusClientHandler, records []fileRecord) ([]fileRecord, error) {
+	request := &modbus.ProtocolDataUnit{FunctionCode: funcCodeReadFileRecord, Data: []byte{0}}
+	for _, record := range records {
+		request.Data = append(request.Data, fileRecordReferenceType)
+		request.Data = appendUint16(request.Data, record.FileNumber, record.RecordNumber, record.RecordLength)
+	}
+	request.Data[0] = byte(len(request.Data) - 1)
+
+	response, err := sendPDU(handler, request)
+	if err != nil {
+		return nil, err
+	}
+	byteCount := int(response.Data[0])
+	if byteCount != len(response.Data)-1 {
+		return nil, fmt.Errorf("modbus: response data size '%v' does not match count '%v'", len(response.Data)-1, byteCount)
+	}
+
+	offset := 1
+	for ndx := range records {
+		if offset+2 > len(response.Data) {
+			return nil, fmt.Errorf("modbus: response truncated in file record '%v'", ndx)
+		}
+		length := int(response.Data[offset])
+		if response.Data[offset+1] != fileRecordReferenceType {
+			return nil, fmt.Errorf("modbus: response reference type '%v' does not match expected '%v'", response.Data[offset+1], fileRecordReferenceType)
+		}
+		if length < 1 || length%2 != 1 || offset+1+length > len(response.Data) {
+			return nil, fmt.Errorf("modbus: response length '%v' of file record '%v' is invalid", length, ndx)
+		}
+
+		recordData := response.Data[offset+2 : offset+1+length]
+		records[ndx].Data = make([]uint16, len(recordData)/2)
+		for register := range records[ndx].Data {
+			records[ndx].Data[register] = binary.BigEndian.Uint16(recordData[register*2:])
+		}
+		offset += 1 + length
+	}
+
+	return records, nil
+}
+
+// writeFileRecords writes the file records. The device echoes the request when
+// every record has been written.
+//
+// Request and response:
+//
+//	Function code         : 1 byte (0x15)
+//	Request data length   : 1 byte
+//	Sub-requests          : reference type (1 byte), file number (2 bytes),
+//	                        record number (2 bytes), record length (2 bytes),
+//	                        record data (Nx2 bytes)
+func writeFileRecords(handler modbusClientHandler, records []fileRecord) error {
+	request := &modbus.ProtocolDataUnit{FunctionCode: funcCodeWriteFileRecord, Data: []byte{0}}
+	for _, record := range records {
+		request.Data = append(request.Data, fileRecordReferenceType)
+		request.Data = appendUint16(request.Data, record.FileNumber, record.RecordNumber, record.RecordLength)
+		request.Data = appendUint16(request.Data, record.Data...)
+	}
+	request.Data[0] = byte(len(request.Data) - 1)
+
+	response, err := sendPDU(handler, request)
+	if err != nil {
+		return err
+	}
+	if string(response.Data) != string(request.Data) {
+		return fmt.Errorf("modbus: response does not match the file records written")
+	}
+	return nil
+}
+
+// appendUint16 appends big endian 16 bit values to the byte slice
+func appendUint16(data []byte, values ...uint16) []byte {
+	for _, value := range values {
+		data = append(data, byte(value>>8), byte(value))
+	}
+	return data
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readRecords returns count file records to read, each of the record length
+func readRecords(count int, recordLength uint16) []fileRecord {
+	records := make([]fileRecord, count)
+	for ndx := range records {
+		records[ndx] = fileRecord{FileNumber: 1, RecordNumber: uint16(ndx), RecordLength: recordLength}
+	}
+	return records
+}
+
+func TestValidateFileRecords(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []fileRecord
+		write   bool
+		err     string
+	}{
+		{"read", []fileRecord{{FileNumber: 4, RecordNumber: 1, RecordLength: 2}}, false, ""},
+		{"write", []fileRecord{{FileNumber: 4, RecordNumber: 7, Data: []uint16{1, 2}}}, true, ""},
+		{"write with RecordLength", []fileRecord{{FileNumber: 4, RecordLength: 2, Data: []uint16{1, 2}}}, true, ""},
+		{"no records", []fileRecord{}, false, "FileRecords must be an array containing at least one file record"},
+		{"FileNumber 0", []fileRecord{{RecordLength: 1}}, false, "FileRecords[0].FileNumber must be an integer between 1 and 65535"},
+		{"RecordNumber too large", []fileRecord{{FileNumber: 1, RecordNumber: 10000, RecordLength: 1}}, false, "FileRecords[0].RecordNumber must be an integer between 0 and 9999"},
+		{"read without RecordLength", []fileRecord{{FileNumber: 1}}, false, "FileRecords[0].RecordLength must be an integer between 1 and 122"},
+		{"read RecordLength too large", []fileRecord{{FileNumber: 1, RecordLength: 123}}, false, "FileRecords[0].RecordLength must be an integer between 1 and 122"},
+		{"write without Data", []fileRecord{{FileNumber: 1, RecordLength: 1}}, true, "FileRecords[0].Data is required for function code 21"},
+		{"write RecordLength mismatch", []fileRecord{{FileNumber: 1, RecordLength: 3, Data: []uint16{1, 2}}}, true, "FileRecords[0].RecordLength must match the number of Data values"},
+		{"largest read response", readRecords(1, 121), false, ""},
+		{"read response too large", readRecords(2, 61), false, "FileRecords exceed the maximum modbus message size"},
+		{"most read records", readRecords(35, 1), false, ""},
+		{"read request too large", readRecords(36, 1), false, "FileRecords exceed the maximum modbus message size"},
+		{"largest write", []fileRecord{{FileNumber: 1, Data: make([]uint16, 119)}}, true, ""},
+		{"write too large", []fileRecord{{FileNumber: 1, Data: make([]uint16, 120)}}, true, "FileRecords exceed the maximum modbus message size"},
+	}
+
+	for _, test := range tests {
+		err := validateFileRecords(test.records, test.write)
+		if (err == nil && test.err != "") || (err != nil && err.Error() != test.err) {
+			t.Errorf("%s: validateFileRecords = %v, want %q", test.name, err, test.err)
+		}
+	}
+
+	//The RecordLength of written records defaults to the number of values
+	records := []fileRecord{{FileNumber: 1, Data: []uint16{1, 2, 3}}}
+	if err := validateFileRecords(records, true); err != nil || records[0].RecordLength != 3 {
+		t.Errorf("validateFileRecords RecordLength = %d, %v, want 3", records[0].RecordLength, err)
+	}
+}
+
+func TestReadFileRecordsOverSerialRTU(t *testing.T) {
+	tests := []struct {
+		name     string
+		response []byte
+		want     [][]uint16
+		err      string
+	}{
+		{
+			name:     "records",
+			response: []byte{12, 5, 6, 0x0D, 0xFE, 0x00, 0x20, 5, 6, 0x33, 0xCD, 0x00, 0x40},
+			want:     [][]uint16{{0x0DFE, 0x0020}, {0x33CD, 0x0040}},
+		},
+		{
+			name:     "reference type mismatch",
+			response: []byte{12, 5, 6, 0x0D, 0xFE, 0x00, 0x20, 5, 7, 0x33, 0xCD, 0x00, 0x40},
+			err:      "modbus: response reference type '7' does not match expected '6'",
+		},
+		{
+			name:     "record length too long",
+			response: []byte{12, 5, 6, 0x0D, 0xFE, 0x00, 0x20, 7, 6, 0x33, 0xCD, 0x00, 0x40},
+			err:      "modbus: response length '7' of file record '1' is invalid",
+		},
+		{
+			name:     "missing record",
+			response: []byte{6, 5, 6, 0x0D, 0xFE, 0x00, 0x20},
+			err:      "modbus: response truncated in file record '1'",
+		},
+	}
+
+	for _, test := range tests {
+		var request []byte
+		response := test.response
+		handler := newRTULoopback(t, func(frame []byte) [][]byte {
+			request = append([]byte(nil), frame...)
+			return byteFrames(rtuFrame(t, funcCodeReadFileRecord, response))
+		})
+
+		records, err := readFileRecords(handler, []fileRecord{
+			{FileNumber: 4, RecordNumber: 1, RecordLength: 2},
+			{FileNumber: 3, RecordNumber: 9, RecordLength: 2},
+		})
+
+		//The example request from the modbus spec
+		wantRequest := []byte{0x0E, 6, 0x00, 0x04, 0x00, 0x01, 0x00, 0x02, 6, 0x00, 0x03, 0x00, 0x09, 0x00, 0x02}
+		if len(request) < 4 || !bytes.Equal(request[2:len(request)-2], wantRequest) {
+			t.Errorf("%s: request = % x, want data % x", test.name, request, wantRequest)
+		}
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: readFileRecords error = %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: readFileRecords returned error: %s", test.name, err)
+			continue
+		}
+		for ndx, record := range records {
+			if !reflect.DeepEqual(record.Data, test.want[ndx]) {
+				t.Errorf("%s: record %d Data = %v, want %v", test.name, ndx, record.Data, test.want[ndx])
+			}
+		}
+	}
+}
+
+func TestReadFileRecordsByteCountMismatch(t *testing.T) {
+	//Serial RTU responses are framed by their byte count, so the mismatch can only
+	//be returned over TCP
+	handler := newPDUResponder(funcCodeReadFileRecord, 14, 5, 6, 0x0D, 0xFE, 0x00, 0x20, 5, 6, 0x33, 0xCD, 0x00, 0x40)
+	_, err := readFileRecords(handler, []fileRecord{
+		{FileNumber: 4, RecordNumber: 1, RecordLength: 2},
+		{FileNumber: 3, RecordNumber: 9, RecordLength: 2},
+	})
+	if want := "modbus: response data size '12' does not match count '14'"; err == nil || err.Error() != want {
+		t.Errorf("readFileRecords error = %v, want %q", err, want)
+	}
+}
+
+func TestWriteFileRecordsOverSerialRTU(t *testing.T) {
+	records := []fileRecord{{FileNumber: 4, RecordNumber: 7, RecordLength: 3, Data: []uint16{0x06AF, 0x04BE, 0x100D}}}
+	//The example request from the modbus spec
+	wantData := []byte{0x0D, 6, 0x00, 0x04, 0x00, 0x07, 0x00, 0x03, 0x06, 0xAF, 0x04, 0xBE, 0x10, 0x0D}
+
+	var request []byte
+	echo := true
+	handler := newRTULoopback(t, func(frame []byte) [][]byte {
+		request = append([]byte(nil), frame...)
+		response := append([]byte(nil), frame[2:len(frame)-2]...)
+		if !echo {
+			response[len(response)-1]++
+		}
+		return byteFrames(rtuFrame(t, funcCodeWriteFileRecord, response))
+	})
+
+	if err := writeFileRecords(handler, records); err != nil {
+		t.Fatalf("writeFileRecords returned error: %s", err)
+	}
+	if len(request) < 4 || request[1] != funcCodeWriteFileRecord || !bytes.Equal(request[2:len(request)-2], wantData) {
+		t.Errorf("request = % x, want data % x", request, wantData)
+	}
+
+	echo = false
+	if err := writeFileRecords(handler, records); err == nil || !strings.Contains(err.Error(), "does not match the file records written") {
+		t.Errorf("writeFileRecords with a mismatched response error = %v", err)
+	}
+}
@@ -6,12 +6,14 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
 	"net"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -32,6 +34,13 @@ const (
 	tcpTimeout                     = 10 * time.Second
 	tcpIdleTimeout                 = 60 * time.Second
 	adapterConfigCollectionDefault = "adapter_config"
+	maxConcurrentRequestsDefault   = 8
+	queueStatusInterval            = 60 * time.Second
+	outboxDirectoryDefault         = "outbox"
+	outboxMaxBytesDefault          = 50 * 1024 * 1024
+	outboxMaxAgeDefault            = 24 * time.Hour
+	outboxRetryInterval            = 30 * time.Second
+	reconnectRetryInterval         = 30 * time.Second
 )
 
 var (
@@ -45,11 +54,15 @@ var (
 	adapterConfigCollection   string
 	topicRoot                 string
 	cbBroker                  cbPlatformBroker
-	cbSubscribeChannel        <-chan *mqttTypes.Publish
+	subscriptionChannel       chan (<-chan *mqttTypes.Publish)
+	reconnecting              int32 //1 while reconnecting to the broker
 	endSubscribeWorkerChannel chan string
 	adapterID                 string
-	modbusHandler             *modbus.TCPClientHandler
-	modbusClient              modbus.Client
+	modbusPool                *modbusConnectionPool
+	maxConcurrentRequests     int //Defaults to 8
+	outboxDirectory           string
+	outboxMaxBytes            int64
+	outboxMaxAge              time.Duration
 )
 
 type cbPlatformBroker struct {
@@ -77,6 +90,10 @@ func init() {
 	flag.StringVar(&topicRoot, "topicRoot", "modbus/command", "The root of all MQTT topics that should be used to publish/subscribe to (optional)")
 	flag.StringVar(&logLevel, "logLevel", "info", "The level of logging to use. Available levels are 'debug, 'info', 'warn', 'error', 'fatal' (optional)")
 	flag.StringVar(&adapterID, "adapterID", "", "Unique identifier for this adapter, typically SiteID where modbus adapter is deployed (optional)")
+	flag.IntVar(&maxConcurrentRequests, "maxConcurrentRequests", maxConcurrentRequestsDefault, "The maximum number of modbus requests to process at the same time (optional)")
+	flag.StringVar(&outboxDirectory, "outboxDirectory", outboxDirectoryDefault, "The directory used to store messages that could not be published, an empty string disables store and forward (optional)")
+	flag.Int64Var(&outboxMaxBytes, "outboxMaxBytes", outboxMaxBytesDefault, "The maximum number of bytes of messages to store while the broker is unreachable (optional)")
+	flag.DurationVar(&outboxMaxAge, "outboxMaxAge", outboxMaxAgeDefault, "The maximum age of stored messages, older messages are dropped (optional)")
 
 }
 
@@ -115,6 +132,14 @@ func main() {
 	}
 	log.SetOutput(filter)
 
+	//Messages that cannot be published are stored until the broker can be reached
+	if outboxDirectory != "" && outboxMaxBytes > 0 {
+		var err error
+		if outbox, err = newOutboundQueue(outboxDirectory, outboxMaxBytes, outboxMaxAge); err != nil {
+			log.Printf("[ERROR] main - Unable to open outbox %s, messages that cannot be published will be dropped: %s\n", outboxDirectory, err.Error())
+		}
+	}
+
 	cbBroker = cbPlatformBroker{
 
 		name:         "ClearBlade",
@@ -129,16 +154,15 @@ func main() {
 		qos:          msgSubscribeQos,
 	}
 
-	// Initialize ClearBlade Client
-	if err := initCbClient(cbBroker); err != nil {
-		log.Println(err.Error())
-		log.Println("Unable to initialize CB broker client. Exiting.")
-		return
-	}
-
 	defer close(endSubscribeWorkerChannel)
 	endSubscribeWorkerChannel = make(chan string)
 
+	//Each new subscription is handed to the subscribe worker
+	subscriptionChannel = make(chan (<-chan *mqttTypes.Publish), 1)
+
+	// Initialize ClearBlade Client
+	initCbClient(cbBroker)
+
 	//Handle OS interrupts to shut down gracefully
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
@@ -152,7 +176,7 @@ func main() {
 }
 
 // ClearBlade Client init helper
-func initCbClient(platformBroker cbPlatformBroker) error {
+func initCbClient(platformBroker cbPlatformBroker) {
 	log.Println("[DEBUG] initCbClient - Initializing the ClearBlade client")
 
 	cbBroker.client = cb.NewDeviceClientWithAddrs(*(platformBroker.platformURL), *(platformBroker.messagingURL), *(platformBroker.systemKey), *(platformBroker.systemSecret), *(platformBroker.username), *(platformBroker.password))
@@ -170,14 +194,22 @@ func initCbClient(platformBroker cbPlatformBroker) error {
 	log.Println("[INFO] main - Retrieving adapter configuration...")
 	getAdapterConfig()
 
+	//Requests are processed, and tags are polled, for as long as the adapter runs,
+	//including while the broker cannot be reached
+	go subscribeWorker()
+
 	log.Println("[DEBUG] initCbClient - Initializing MQTT")
-	callbacks := cb.Callbacks{OnConnectionLostCallback: OnConnectLost, OnConnectCallback: OnConnect}
-	if err := cbBroker.client.InitializeMQTTWithCallback(platformBroker.clientID, "", 30, nil, nil, &callbacks); err != nil {
-		log.Fatalf("[FATAL] initCbClient - Unable to initialize MQTT connection with %s: %s", platformBroker.name, err.Error())
-		return err
+	for err := initializeMQTT(platformBroker); err != nil; err = initializeMQTT(platformBroker) {
+		log.Printf("[ERROR] initCbClient - Unable to initialize MQTT connection with %s: %s\n", platformBroker.name, err.Error())
+		log.Printf("[ERROR] initCbClient - Will retry in %s...\n", reconnectRetryInterval)
+		time.Sleep(reconnectRetryInterval)
 	}
+}
 
-	return nil
+// initializeMQTT connects to the MQTT broker of the platform
+func initializeMQTT(platformBroker cbPlatformBroker) error {
+	callbacks := cb.Callbacks{OnConnectionLostCallback: OnConnectLost, OnConnectCallback: OnConnect}
+	return cbBroker.client.InitializeMQTTWithCallback(platformBroker.clientID, "", 30, nil, nil, &callbacks)
 }
 
 //If the connection to the broker is lost, we need to reconnect and
@@ -185,12 +217,34 @@ func initCbClient(platformBroker cbPlatformBroker) error {
 func OnConnectLost(client mqtt.Client, connerr error) {
 	log.Printf("[INFO] OnConnectLost - Connection to broker was lost: %s\n", connerr.Error())
 
-	//End the existing goRoutines
-	endSubscribeWorkerChannel <- "Stop Channel"
+	//We can't rely on MQTT auto-reconnect because it is most likely that our auth token expired,
+	//so the lost connection is closed and the adapter reauthenticates. Requests and polls
+	//continue to be processed meanwhile, and messages that cannot be published are stored.
+	client.Disconnect(0)
+	go reconnect()
+}
+
+// reconnect reauthenticates with the platform and reconnects to the MQTT broker,
+// retrying until it succeeds. The subscriptions are re-established by OnConnect.
+func reconnect() {
+	if !atomic.CompareAndSwapInt32(&reconnecting, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&reconnecting, 0)
 
-	//We can't rely on MQTT auto-reconnect because it is most likely that our auth token expired
-	//When the connection is lost, just exit
-	log.Fatalln("[FATAL] onConnectLost - MQTT Connection was lost. Stopping Adapter to force device reauth.")
+	for {
+		log.Printf("[INFO] reconnect - Reconnecting to %s\n", cbBroker.name)
+		_, err := cbBroker.client.Authenticate()
+		if err == nil {
+			err = initializeMQTT(cbBroker)
+		}
+		if err == nil {
+			return
+		}
+		log.Printf("[ERROR] reconnect - Unable to reconnect to %s: %s\n", cbBroker.name, err.Error())
+		log.Printf("[ERROR] reconnect - Will retry in %s...\n", reconnectRetryInterval)
+		time.Sleep(reconnectRetryInterval)
+	}
 }
 
 //When the connection to the broker is complete, set up the subscriptions
@@ -202,78 +256,91 @@ func OnConnect(client mqtt.Client) {
 	//We therefore need to re-subscribe
 	log.Println("[DEBUG] OnConnect - Begin Configuring Subscription(s)")
 
-	var err error
-	for cbSubscribeChannel, err = subscribe(topic); err != nil; {
+	subscription, err := subscribe(topic)
+	for err != nil {
 		//Wait 30 seconds and retry
 		log.Printf("[ERROR] OnConnect - Error subscribing to MQTT: %s\n", err.Error())
 		log.Println("[ERROR] OnConnect - Will retry in 30 seconds...")
 		time.Sleep(time.Duration(30 * time.Second))
-		cbSubscribeChannel, err = subscribe(topicRoot + "/request")
+		subscription, err = subscribe(topicRoot + "/request")
 	}
 
-	//Start subscribe worker
-	go subscribeWorker()
+	//Hand the subscription to the subscribe worker, replacing any it has not yet received
+	select {
+	case <-subscriptionChannel:
+	default:
+	}
+	subscriptionChannel <- subscription
+
+	//Deliver any messages stored while the broker was unreachable
+	if outbox != nil {
+		outbox.forward()
+	}
 }
 
 func subscribeWorker() {
 	log.Println("[INFO] subscribeWorker - Starting subscribeWorker")
 
-	log.Println("[INFO] subscribeWorker - Initializing the modbus handler")
-	modbusHandler = &modbus.TCPClientHandler{}
-	modbusHandler.Timeout = tcpTimeout
-	modbusHandler.IdleTimeout = tcpIdleTimeout
+	log.Println("[INFO] subscribeWorker - Initializing the modbus connection pool")
+	modbusPool = newModbusConnectionPool(tcpIdleTimeout)
+	defer modbusPool.closeAll()
 
-	if strings.ToUpper(logLevel) == "DEBUG" {
-		modbusHandler.Logger = log.New(os.Stdout, "", log.LstdFlags|log.Lshortfile)
-	}
+	//Check for idle connections twice per idle timeout period
+	evictTicker := time.NewTicker(tcpIdleTimeout / 2)
+	defer evictTicker.Stop()
+
+	//Requests are processed concurrently, one worker per modbus host
+	dispatcher := newRequestDispatcher(maxConcurrentRequests, handleRequest)
 
-	defer modbusHandler.Close()
+	//Configured tags are polled through the workers of their modbus hosts
+	poller := startPoller(pollGroups, dispatcher)
 
-	//Wait for subscriptions to be received
+	statusTicker := time.NewTicker(queueStatusInterval)
+	defer statusTicker.Stop()
+
+	//Retry the delivery of stored messages
+	outboxTicker := time.NewTicker(outboxRetryInterval)
+	defer outboxTicker.Stop()
+
+	//Wait for subscriptions to be received. There is no subscription while the
+	//broker cannot be reached, but configured tags continue to be polled.
+	var requests <-chan *mqttTypes.Publish
 	log.Println("[INFO] subscribeWorker - Waiting for modbus requests")
 	for {
 		select {
-		case message, ok := <-cbSubscribeChannel:
-			if ok {
-				log.Println("[INFO] subscribeWorker - request received")
-				handleRequest(message.Payload)
+		case requests = <-subscriptionChannel:
+			log.Println("[DEBUG] subscribeWorker - Subscription to requests established")
+		case message, ok := <-requests:
+			if !ok {
+				//The subscription ends when the connection to the broker is lost
+				requests = nil
+				continue
+			}
+			log.Println("[INFO] subscribeWorker - request received")
+			dispatcher.dispatch(message.Payload)
+		case <-evictTicker.C:
+			modbusPool.evictIdle()
+		case <-statusTicker.C:
+			publishQueueDepth(dispatcher)
+		case <-outboxTicker.C:
+			if outbox != nil && outbox.pending() > 0 {
+				outbox.forward()
 			}
 		case _ = <-endSubscribeWorkerChannel:
 			//End the current go routine when the stop signal is received
 			log.Println("[INFO] subscribeWorker - Stopping subscribeWorker")
+			poller.stop()
+			dispatcher.stop()
 			return
 		}
 	}
 }
 
-func resetModbusClient(address string) (err error) {
-	log.Printf("[DEBUG] resetModbusClient - new address = %s\n", address)
-	log.Println("[DEBUG] resetModbusClient - Closing modbus handler")
-	modbusHandler.Close()
-
-	if address == "" {
-		log.Printf("[DEBUG] resetModbusClient - Invalid address for modbus host: %s\n", address)
-		return fmt.Errorf("Invalid address for modbus host: %s", address)
-	}
-
-	modbusHandler.Address = address
-
-	// Connect to modbus manually so that multiple requests are handled in one connection session
-	log.Println("[DEBUG] resetModbusClient - Connecting modbus handler")
-	if err = modbusHandler.Connect(); err != nil {
-		//We need to reset the address to blank in order to avoid a nil pointer exception in the
-		//handleModbusRequest function
-		modbusHandler.Address = ""
-		return
-	}
-	modbusClient = modbus.NewClient(modbusHandler)
-	return
-}
-
 func handleRequest(payload []byte) {
 	// The json request should resemble the following:
 	//{
 	//'ModbusHost': modbus.com:5023
+	//'UnitID': 1,
 	//'FunctionCode': 5,
 	//'StartAddress': 2,
 	//'AddressCount': 2,
@@ -282,128 +349,118 @@ func handleRequest(payload []byte) {
 	log.Println("[INFO] handleRequest - processing request")
 	log.Printf("[DEBUG] handleRequest - Json payload received: %s\n", string(payload))
 
-	var jsonPayload map[string]interface{}
-	var errorCode = 0
-
-	if err := json.Unmarshal(payload, &jsonPayload); err != nil {
-		log.Printf("[ERROR] handleRequest - Error encountered unmarshalling json: %s\n", err.Error())
-		addErrorToPayload(jsonPayload, "Error encountered unmarshalling json: "+err.Error(), errorCode)
-		jsonPayload["request"] = payload
-	} else {
-		log.Printf("[DEBUG] handleRequest - Json payload received: %#v\n", jsonPayload)
-	}
-
-	if jsonPayload["ModbusHost"] == nil {
-		log.Println("[ERROR] handleRequest - ModbusHost not specified in incoming payload")
-		addErrorToPayload(jsonPayload, "ModbusHost is required", errorCode)
-		jsonPayload["request"] = payload
+	request, err := decodeRequest(payload)
+	if err != nil {
+		log.Printf("[ERROR] handleRequest - Error encountered decoding request: %s\n", err.Error())
+		response := newModbusResponse(nil)
+		addErrorToResponse(response, err.Error(), 0)
+		response.Request = payload
+		publishModbusResponse(response)
+		return
 	}
-
-	if jsonPayload["FunctionCode"] == nil {
-		log.Println("[ERROR] handleRequest - FunctionCode not specified in incoming payload")
-		addErrorToPayload(jsonPayload, "FunctionCode is required", errorCode)
-		jsonPayload["request"] = payload
-	} else {
-
-		log.Printf("FunctionCode received = %d", uint16(jsonPayload["FunctionCode"].(float64)))
-
-		if uint16(jsonPayload["FunctionCode"].(float64)) != modbus.FuncCodeReadDiscreteInputs &&
-			uint16(jsonPayload["FunctionCode"].(float64)) != modbus.FuncCodeReadCoils &&
-			uint16(jsonPayload["FunctionCode"].(float64)) != modbus.FuncCodeWriteSingleCoil &&
-			uint16(jsonPayload["FunctionCode"].(float64)) != modbus.FuncCodeWriteMultipleCoils &&
-			uint16(jsonPayload["FunctionCode"].(float64)) != modbus.FuncCodeReadInputRegisters &&
-			uint16(jsonPayload["FunctionCode"].(float64)) != modbus.FuncCodeReadHoldingRegisters &&
-			uint16(jsonPayload["FunctionCode"].(float64)) != modbus.FuncCodeWriteSingleRegister &&
-			uint16(jsonPayload["FunctionCode"].(float64)) != modbus.FuncCodeWriteMultipleRegisters {
-			//uint16(jsonPayload["FunctionCode"].(float64)) != modbus.FuncCodeReadWriteMultipleRegisters {
-			//uint16(jsonPayload["FunctionCode"].(float64)) != modbus.FuncCodeMaskWriteRegister &&
-			//uint16(jsonPayload["FunctionCode"].(float64)) != modbus.FuncCodeReadFIFOQueue {
-
-			log.Println("[ERROR] handleRequest - FunctionCode specified in incoming payload is invalid")
-			addErrorToPayload(jsonPayload, "Invalid FunctionCode", modbus.ExceptionCodeIllegalFunction)
-			jsonPayload["request"] = payload
-		}
+	log.Printf("[DEBUG] handleRequest - Request decoded: %#v\n", request)
+
+	if err := validateRequest(request); err != nil {
+		log.Printf("[ERROR] handleRequest - Request is invalid: %s\n", err.Error())
+		response := newModbusResponse(request)
+		addErrorToResponse(response, err.Error(), requestErrorCode(err))
+		response.Request = payload
+		publishModbusResponse(response)
+		return
 	}
 
-	if jsonPayload["StartAddress"] == nil {
-		log.Println("[ERROR] handleRequest - StartAddress not specified in incoming payload")
-		addErrorToPayload(jsonPayload, "StartAddress is required", errorCode)
-		jsonPayload["request"] = payload
-	}
+	response := newModbusResponse(request)
+	err = handleModbusRequest(request, response)
 
-	if jsonPayload["AddressCount"] == nil &&
-		(uint16(jsonPayload["FunctionCode"].(float64)) == modbus.FuncCodeReadDiscreteInputs ||
-			uint16(jsonPayload["FunctionCode"].(float64)) == modbus.FuncCodeReadCoils ||
-			uint16(jsonPayload["FunctionCode"].(float64)) == modbus.FuncCodeWriteMultipleCoils ||
-			uint16(jsonPayload["FunctionCode"].(float64)) == modbus.FuncCodeReadInputRegisters ||
-			uint16(jsonPayload["FunctionCode"].(float64)) == modbus.FuncCodeReadHoldingRegisters ||
-			uint16(jsonPayload["FunctionCode"].(float64)) == modbus.FuncCodeWriteMultipleRegisters ||
-			uint16(jsonPayload["FunctionCode"].(float64)) == modbus.FuncCodeReadWriteMultipleRegisters) {
-		log.Println("[ERROR] handleRequest - AddressCount not specified in incoming payload and is required for the specified function code.")
-		addErrorToPayload(jsonPayload, "AddressCount is required", errorCode)
-		jsonPayload["request"] = payload
-	}
+	log.Printf("[DEBUG] handleRequest - err = %#v\n", err)
+	log.Printf("[DEBUG] handleRequest - response = %#v\n", response)
 
-	if jsonPayload["Data"] == nil &&
-		(uint16(jsonPayload["FunctionCode"].(float64)) == modbus.FuncCodeWriteSingleCoil ||
-			uint16(jsonPayload["FunctionCode"].(float64)) == modbus.FuncCodeWriteMultipleCoils ||
-			uint16(jsonPayload["FunctionCode"].(float64)) == modbus.FuncCodeWriteSingleRegister ||
-			uint16(jsonPayload["FunctionCode"].(float64)) == modbus.FuncCodeWriteMultipleRegisters ||
-			uint16(jsonPayload["FunctionCode"].(float64)) == modbus.FuncCodeMaskWriteRegister ||
-			uint16(jsonPayload["FunctionCode"].(float64)) == modbus.FuncCodeReadWriteMultipleRegisters) {
-		log.Println("[ERROR] handleRequest - Data not specified in incoming payload and is required for the specified function code.")
-		addErrorToPayload(jsonPayload, "Data is required for 'write' function codes", errorCode)
-		jsonPayload["request"] = payload
+	if err != nil {
+		log.Printf("[ERROR] handleRequest - Error encountered: %s\n", err.Error())
+		addErrorToResponse(response, err.Error(), requestFailureCode(request, err))
+	} else {
+		response.Success = true
 	}
 
-	if jsonPayload["error"] == nil {
-		err := handleModbusRequest(jsonPayload)
-
-		log.Printf("[DEBUG] handleRequest - err = %#v\n", err)
-		log.Printf("[DEBUG] handleRequest - jsonPayload = %#v\n", jsonPayload)
+	log.Println("[INFO] handleRequest - publishing response")
+	publishModbusResponse(response)
+}
 
-		if err != nil {
-			log.Printf("[ERROR] handleRequest - Error encountered: %s\n", err.Error())
-			switch err.(type) {
-			case *net.OpError:
-				log.Printf("[DEBUG] handleRequest - net.OpError received\n")
-				//We have a network issue. At this point, we need to continually try and reconnect.
-				modbusHandler.Address = ""
-			case *modbus.ModbusError:
-				log.Printf("[DEBUG] handleRequest - modbus.ModbusError received:  %#v\n", err)
-				//extract the modbus exception code
-				errorCode = int(err.(*modbus.ModbusError).ExceptionCode)
-				log.Printf("[DEBUG] handleRequest - modbus exception code = %d\n", errorCode)
-			}
-			addErrorToPayload(jsonPayload, err.Error(), errorCode)
-		} else {
-			if jsonPayload["success"] == nil {
-				jsonPayload["success"] = true
-			}
+// requestFailureCode returns the error code reported for a request that failed
+// while communicating with the modbus device. The connection to the device is
+// dropped after a network error, and after any error of a serially framed
+// connection other than an exception response, so that the next request
+// reconnects. A serial port that timed out or returned an I/O error, such as a
+// USB adapter that was unplugged, may be gone or out of sync with the device.
+func requestFailureCode(request *modbusRequest, err error) int {
+	var errorCode = 0
+	switch err.(type) {
+	case *net.OpError:
+		log.Printf("[DEBUG] requestFailureCode - net.OpError received\n")
+		//We have a network issue. Drop the connection so the next request reconnects.
+		modbusPool.remove(request.ModbusHost)
+	case *modbus.ModbusError:
+		log.Printf("[DEBUG] requestFailureCode - modbus.ModbusError received:  %#v\n", err)
+		//extract the modbus exception code
+		errorCode = int(err.(*modbus.ModbusError).ExceptionCode)
+		log.Printf("[DEBUG] requestFailureCode - modbus exception code = %d\n", errorCode)
+	case *portConflictError:
+		//The serial port remains open for the ModbusHost that is using it
+	default:
+		target, parseErr := parseModbusHost(request.ModbusHost)
+		if parseErr == nil && target.serialFramed() {
+			//Serial framing errors (LRC/CRC mismatches, malformed frames) have their own codes
+			errorCode = transportErrorCode(err)
+			log.Printf("[DEBUG] requestFailureCode - transport error code = %d\n", errorCode)
+			log.Printf("[DEBUG] requestFailureCode - Dropping the connection to %s after error: %s\n", request.ModbusHost, err.Error())
+			modbusPool.remove(request.ModbusHost)
 		}
 	}
-
-	log.Println("[INFO] handleRequest - publishing response")
-	publishModbusResponse(jsonPayload)
+	return errorCode
 }
 
-func handleModbusRequest(payload map[string]interface{}) error {
-	// Modbus TCP
+// handleModbusRequest sends a validated request to the modbus device and adds the
+// results to the response
+func handleModbusRequest(request *modbusRequest, response *modbusResponse) error {
+	// Modbus TCP, RTU or ASCII, depending on the ModbusHost
 	var modbusResults []byte
+	var fifoValues []uint16
 	var err error
 
-	//See if the modbus address changed
-	if modbusHandler.Address != payload["ModbusHost"] {
-		log.Println("[INFO] handleModbusRequest - Modbus host address modified. Resetting Modbus Client")
-		if err := resetModbusClient(payload["ModbusHost"].(string)); err != nil {
-			return err
-		}
+	//Retrieve the connection to the modbus host from the pool
+	conn, err := modbusPool.get(request.ModbusHost)
+	if err != nil {
+		return err
+	}
+	modbusClient := conn.client
+
+	//Address the request to the requested unit, which allows a single gateway to
+	//serve many downstream slaves
+	var unitID byte
+	if request.UnitID != nil {
+		unitID = *request.UnitID
+	} else {
+		unitID = defaultUnitID(conn.handler)
 	}
+	setUnitID(conn.handler, unitID)
+	response.UnitID = &unitID
 
-	functionCode := int(payload["FunctionCode"].(float64))
-	startAddress := uint16(payload["StartAddress"].(float64))
-	addressCount := uint16(payload["AddressCount"].(float64))
+	if request.RawPDU != nil {
+		return handleRawRequest(conn.handler, request, response)
+	}
 
+	functionCode := int(*request.FunctionCode)
+	var startAddress uint16
+	if request.StartAddress != nil {
+		startAddress = *request.StartAddress
+	}
+	var addressCount uint16
+	if request.AddressCount != nil {
+		addressCount = *request.AddressCount
+	}
+	byteOrder := requestRegisterFormat(request).byteOrder
+
+	log.Printf("[DEBUG] handleModbusRequest - unit id = %d\n", unitID)
 	log.Printf("[DEBUG] handleModbusRequest - function code = %d\n", functionCode)
 	log.Printf("[DEBUG] handleModbusRequest - start address = %d\n", startAddress)
 	log.Printf("[DEBUG] handleModbusRequest - address count = %d\n", addressCount)
@@ -419,23 +476,16 @@ func handleModbusRequest(payload map[string]interface{}) error {
 		log.Println("[DEBUG] handleModbusRequest - invoking FuncCodeWriteSingleCoil")
 		var modbusData uint16 = 0x0000
 
-		switch payload["Data"].([]interface{})[0].(type) {
-		case float64:
-			if payload["Data"].([]interface{})[0].(float64) == 1 {
-				modbusData = 0xFF00
-			}
-		case bool:
-			if payload["Data"].([]interface{})[0].(bool) == true {
-				modbusData = 0xFF00
-			}
-		default:
-			log.Println("[ERROR] handleModbusRequest - Invalid data value passed for function code")
+		coils, _ := coilValues(request.Data)
+		if coils[0] {
+			modbusData = 0xFF00
 		}
 
 		modbusResults, err = modbusClient.WriteSingleCoil(startAddress, modbusData)
 	case modbus.FuncCodeWriteMultipleCoils:
 		log.Println("[DEBUG] handleModbusRequest - invoking FuncCodeWriteMultipleCoils")
-		modbusResults, err = modbusClient.WriteMultipleCoils(startAddress, addressCount, translateDataToModbusBytes(functionCode, payload["Data"].([]bool)))
+		coils, _ := coilValues(request.Data)
+		modbusResults, err = modbusClient.WriteMultipleCoils(startAddress, addressCount, translateDataToModbusBytes(coils))
 	case modbus.FuncCodeReadInputRegisters:
 		log.Println("[DEBUG] handleModbusRequest - invoking FuncCodeReadInputRegisters")
 		modbusResults, err = modbusClient.ReadInputRegisters(startAddress, addressCount)
@@ -444,19 +494,70 @@ func handleModbusRequest(payload map[string]interface{}) error {
 		modbusResults, err = modbusClient.ReadHoldingRegisters(startAddress, addressCount)
 	case modbus.FuncCodeWriteSingleRegister:
 		log.Println("[DEBUG] handleModbusRequest - invoking FuncCodeWriteSingleRegister")
-		modbusResults, err = modbusClient.WriteSingleRegister(startAddress, uint16(payload["Data"].([]float64)[0]))
+		var writeData []byte
+		if writeData, err = registerWriteData(request, byteOrder); err != nil {
+			return err
+		}
+		modbusResults, err = modbusClient.WriteSingleRegister(startAddress, binary.BigEndian.Uint16(writeData))
 	case modbus.FuncCodeWriteMultipleRegisters:
 		log.Println("[DEBUG] handleModbusRequest - invoking FuncCodeWriteMultipleRegisters")
-		modbusResults, err = modbusClient.WriteMultipleRegisters(startAddress, addressCount, payload["Data"].([]byte))
-		//case modbus.FuncCodeReadWriteMultipleRegisters:
-		//	log.Println("[DEBUG] handleModbusRequest - invoking FuncCodeReadWriteMultipleRegisters")
-		//	modbusResults, err = client.ReadWriteMultipleRegisters(startAddress, payload["AddressCount"].(uint16),)
-		//case modbus.FuncCodeMaskWriteRegister:
-		//	log.Println("[DEBUG] handleModbusRequest - invoking FuncCodeMaskWriteRegister")
-		//	modbusResults, err = client.MaskWriteRegister(startAddress)
-		//case modbus.FuncCodeReadFIFOQueue:
-		//	log.Println("[DEBUG] handleModbusRequest - invoking FuncCodeReadFIFOQueue")
-		//	modbusResults, err = client.ReadFIFOQueue(startAddress)
+		var writeData []byte
+		if writeData, err = registerWriteData(request, byteOrder); err != nil {
+			return err
+		}
+		modbusResults, err = modbusClient.WriteMultipleRegisters(startAddress, uint16(len(writeData)/2), writeData)
+	case modbus.FuncCodeMaskWriteRegister:
+		log.Println("[DEBUG] handleModbusRequest - invoking FuncCodeMaskWriteRegister")
+		modbusResults, err = modbusClient.MaskWriteRegister(startAddress, *request.AndMask, *request.OrMask)
+	case modbus.FuncCodeReadWriteMultipleRegisters:
+		log.Println("[DEBUG] handleModbusRequest - invoking FuncCodeReadWriteMultipleRegisters")
+		//The write is performed before the read, so the registers read reflect the values written
+		var writeData []byte
+		if writeData, err = registerWriteData(request, byteOrder); err != nil {
+			return err
+		}
+		writeAddressCount := uint16(len(writeData) / 2)
+		response.WriteAddressCount = &writeAddressCount
+		modbusResults, err = modbusClient.ReadWriteMultipleRegisters(startAddress, addressCount, *request.WriteStartAddress, writeAddressCount, writeData)
+	case modbus.FuncCodeReadFIFOQueue:
+		log.Println("[DEBUG] handleModbusRequest - invoking FuncCodeReadFIFOQueue")
+		fifoValues, err = readFIFOQueue(conn.handler, startAddress)
+	case funcCodeReadExceptionStatus:
+		log.Println("[DEBUG] handleModbusRequest - invoking ReadExceptionStatus")
+		response.ExceptionStatus, err = readExceptionStatus(conn.handler)
+	case funcCodeDiagnostics:
+		log.Println("[DEBUG] handleModbusRequest - invoking Diagnostics")
+		var value uint16
+		if len(request.Data) > 0 {
+			value = uint16(request.Data[0].(float64))
+		}
+		response.Diagnostics, err = diagnostics(conn.handler, *request.SubFunction, value)
+	case funcCodeReportServerID:
+		log.Println("[DEBUG] handleModbusRequest - invoking ReportServerID")
+		response.ServerID, err = reportServerID(conn.handler)
+	case funcCodeReadFileRecord:
+		log.Println("[DEBUG] handleModbusRequest - invoking ReadFileRecord")
+		response.FileRecords, err = readFileRecords(conn.handler, request.FileRecords)
+	case funcCodeWriteFileRecord:
+		log.Println("[DEBUG] handleModbusRequest - invoking WriteFileRecord")
+		err = writeFileRecords(conn.handler, request.FileRecords)
+	case funcCodeEncapsulatedInterface:
+		log.Println("[DEBUG] handleModbusRequest - invoking ReadDeviceIdentification")
+		var readDeviceIDCode byte = readDeviceIDBasic
+		if request.ReadDeviceIDCode != nil {
+			readDeviceIDCode = *request.ReadDeviceIDCode
+		}
+		var objectID byte
+		if request.ObjectID != nil {
+			objectID = *request.ObjectID
+		}
+		var deviceID map[string]string
+		var conformityLevel byte
+		if deviceID, conformityLevel, err = readDeviceIdentification(conn.handler, readDeviceIDCode, objectID); err == nil {
+			response.ReadDeviceIDCode = &readDeviceIDCode
+			response.ConformityLevel = &conformityLevel
+			response.DeviceIdentification = deviceID
+		}
 	}
 
 	log.Printf("[DEBUG] modbusResults = %#v\n", modbusResults)
@@ -468,35 +569,110 @@ func handleModbusRequest(payload map[string]interface{}) error {
 	log.Printf("[DEBUG] function code = %d\n", functionCode)
 
 	switch functionCode {
-	case modbus.FuncCodeReadDiscreteInputs,
-		modbus.FuncCodeReadCoils, modbus.FuncCodeWriteSingleCoil, modbus.FuncCodeWriteMultipleCoils:
-		log.Printf("[DEBUG] handleModbusRequest - adding results to Data field in payload: %#v\n", modbusResults)
-		payload["Data"] = translateModbusBytesToData(modbusResults, addressCount)
-
-		log.Printf("[DEBUG] payload.Data set, payload = %#v\n", payload)
-	default:
-		log.Printf("[DEBUG] handleModbusRequest - adding default bytes to data field in payload: %#v\n", modbusResults)
-		var data []uint16
-		for x := uint16(0); x < addressCount; x++ {
-			data = append(data, binary.BigEndian.Uint16(modbusResults[x*2:(x*2)+2]))
+	case modbus.FuncCodeReadDiscreteInputs, modbus.FuncCodeReadCoils:
+		log.Printf("[DEBUG] handleModbusRequest - adding results to Data field in response: %#v\n", modbusResults)
+		response.Data = translateModbusBytesToData(modbusResults, addressCount)
+
+		log.Printf("[DEBUG] response.Data set, response = %#v\n", response)
+	case modbus.FuncCodeReadFIFOQueue:
+		log.Printf("[DEBUG] handleModbusRequest - adding FIFO queue to response: %#v\n", fifoValues)
+		fifoCount := len(fifoValues)
+		response.FIFOCount = &fifoCount
+		response.Data = fifoValues
+	case funcCodeEncapsulatedInterface, funcCodeReadExceptionStatus, funcCodeDiagnostics, funcCodeReportServerID,
+		funcCodeReadFileRecord, funcCodeWriteFileRecord:
+		log.Println("[DEBUG] handleModbusRequest - structured results added to response")
+	case modbus.FuncCodeWriteSingleCoil:
+		//The device echoes the coil value written, 0xFF00 for on
+		log.Printf("[DEBUG] handleModbusRequest - adding coil written to response: %#v\n", modbusResults)
+		response.Data = []bool{binary.BigEndian.Uint16(modbusResults) == 0xFF00}
+	case modbus.FuncCodeWriteMultipleCoils, modbus.FuncCodeWriteSingleRegister, modbus.FuncCodeWriteMultipleRegisters:
+		//The device echoes the number of coils or registers written, or the register value written
+		log.Printf("[DEBUG] handleModbusRequest - adding write results to response: %#v\n", modbusResults)
+		response.Data = []uint16{binary.BigEndian.Uint16(modbusResults)}
+	case modbus.FuncCodeMaskWriteRegister:
+		//The device echoes the AND and OR masks that were applied
+		log.Printf("[DEBUG] handleModbusRequest - adding masks to response: %#v\n", modbusResults)
+		andMask := binary.BigEndian.Uint16(modbusResults[0:2])
+		orMask := binary.BigEndian.Uint16(modbusResults[2:4])
+		response.AndMask = &andMask
+		response.OrMask = &orMask
+	case modbus.FuncCodeReadHoldingRegisters, modbus.FuncCodeReadInputRegisters, modbus.FuncCodeReadWriteMultipleRegisters:
+		log.Printf("[DEBUG] handleModbusRequest - adding registers to data field in response: %#v\n", modbusResults)
+		if response.Data, err = registerData(request, modbusResults); err != nil {
+			return err
 		}
-		payload["Data"] = data
+	default:
+		log.Printf("[DEBUG] handleModbusRequest - adding default bytes to data field in response: %#v\n", modbusResults)
+		response.Data = translateModbusBytesToRegisters(modbusResults, addressCount)
 	}
 
-	log.Printf("[DEBUG] returning payload, payload = %#v\n", payload)
+	log.Printf("[DEBUG] returning response, response = %#v\n", response)
 
 	return nil
 }
 
-func addErrorToPayload(payload map[string]interface{}, errMsg string, errCode int) {
-	payload["success"] = false
-	payload["error"] = make(map[string]interface{})
+// registerData converts the registers read for a request to the Data of the
+// response. The registers are returned as 16 bit integers, or decoded as the
+// requested data types, and are scaled to engineering units when requested.
+func registerData(request *modbusRequest, modbusResults []byte) (interface{}, error) {
+	format := requestRegisterFormat(request)
+
+	if request.DataType == "" && request.DataTypes == nil {
+		registers := translateModbusBytesToRegisters(reorderRegisterBytes(modbusResults, 1, format.byteOrder), uint16(len(modbusResults)/2))
+		if isScaled(request) {
+			return scaleRegisters(registers, requestScale(request)), nil
+		}
+		return registers, nil
+	}
+
+	log.Printf("[DEBUG] registerData - decoding typed values: %#v\n", modbusResults)
+	dataTypes, _ := requestDataTypes(request)
+	values, err := translateRegistersToValues(modbusResults, dataTypes, format)
+	if err != nil {
+		return nil, err
+	}
+	if isScaled(request) {
+		values = scaleValues(values, requestScale(request))
+	}
+	return values, nil
+}
+
+func handleRawRequest(handler modbusClientHandler, request *modbusRequest, response *modbusResponse) error {
+	functionCode := *request.FunctionCode
+	encoding, _ := rawEncoding(request.RawEncoding)
+	data, _ := decodeRawPDU(*request.RawPDU, encoding)
 
-	payload["error"].(map[string]interface{})["code"] = errCode
+	log.Printf("[DEBUG] handleRawRequest - function code = %d\n", functionCode)
+	log.Printf("[DEBUG] handleRawRequest - raw pdu = % x\n", data)
 
-	if errMsg != "" {
-		payload["error"].(map[string]interface{})["message"] = errMsg
+	rawResponse, err := sendRawPDU(handler, functionCode, data)
+	if err != nil {
+		return err
 	}
+
+	log.Printf("[DEBUG] handleRawRequest - raw response = % x\n", rawResponse)
+	response.RawEncoding = encoding
+	response.RawResponse = encodeRawPDU(rawResponse, encoding)
+	return nil
+}
+
+// requiresStartAddress returns false for the function codes that do not access a
+// coil or register: device identification, the serial line diagnostic function
+// codes and the file record function codes
+func requiresStartAddress(functionCode uint16) bool {
+	switch functionCode {
+	case funcCodeEncapsulatedInterface, funcCodeReadExceptionStatus, funcCodeDiagnostics,
+		funcCodeReportServerID, funcCodeReadFileRecord, funcCodeWriteFileRecord:
+		return false
+	}
+	return true
+}
+
+// isIntegerInRange returns true if the json value is a whole number between min and max
+func isIntegerInRange(value interface{}, min float64, max float64) bool {
+	number, ok := value.(float64)
+	return ok && number >= min && number <= max && number == math.Trunc(number)
 }
 
 // Subscribes to a topic
@@ -512,12 +688,24 @@ func subscribe(topic string) (<-chan *mqttTypes.Publish, error) {
 	return subscription, nil
 }
 
-// Publishes data to a topic
+// Publishes data to a topic. Messages that cannot be published are stored in the
+// outbox and published once the broker can be reached, in the order they were
+// captured.
 func publish(topic string, data string) error {
+	captured := time.Now()
+
+	//Messages are queued behind any stored messages, so that they are delivered in order
+	if outbox != nil && outbox.pending() > 0 {
+		return storeMessage(topic, data, captured)
+	}
+
 	log.Printf("[DEBUG] publish - Publishing to topic %s\n", topic)
 	error := cbBroker.client.Publish(topic, []byte(data), cbBroker.qos)
 	if error != nil {
 		log.Printf("[ERROR] publish - Unable to publish to topic: %s due to error: %s\n", topic, error.Error())
+		if outbox != nil {
+			return storeMessage(topic, data, captured)
+		}
 		return error
 	}
 
@@ -525,6 +713,18 @@ func publish(topic string, data string) error {
 	return nil
 }
 
+// storeMessage stores a message in the outbox and starts delivering the stored messages
+func storeMessage(topic string, data string, captured time.Time) error {
+	if err := outbox.add(topic, data, captured); err != nil {
+		log.Printf("[ERROR] storeMessage - Unable to store message for topic: %s due to error: %s\n", topic, err.Error())
+		return err
+	}
+
+	log.Printf("[DEBUG] storeMessage - Stored message for topic %s, %d message(s) waiting to be published\n", topic, outbox.pending())
+	outbox.forward()
+	return nil
+}
+
 func getAdapterConfig() {
 	log.Println("[INFO] getAdapterConfig - Retrieving adapter config")
 
@@ -550,30 +750,50 @@ func getAdapterConfig() {
 			} else {
 				log.Printf("[DEBUG] getAdapterConfig - Topic root is nil. Using default value %s\n", topicRoot)
 			}
+
+			//device profiles
+			if results["DATA"].([]interface{})[0].(map[string]interface{})["device_profiles"] != nil {
+				log.Println("[DEBUG] getAdapterConfig - Loading device profiles")
+				if err := loadDeviceProfiles(results["DATA"].([]interface{})[0].(map[string]interface{})["device_profiles"]); err != nil {
+					log.Printf("[ERROR] getAdapterConfig - Device profiles could not be loaded: %s\n", err.Error())
+				}
+			} else {
+				log.Println("[DEBUG] getAdapterConfig - Device profiles is nil. No device profiles loaded")
+			}
+
+			//poll configuration, loaded after the device profiles that its tags may use
+			if results["DATA"].([]interface{})[0].(map[string]interface{})["poll_config"] != nil {
+				log.Println("[DEBUG] getAdapterConfig - Loading poll configuration")
+				if err := loadPollConfig(results["DATA"].([]interface{})[0].(map[string]interface{})["poll_config"]); err != nil {
+					log.Printf("[ERROR] getAdapterConfig - Poll configuration could not be loaded: %s\n", err.Error())
+				}
+			} else {
+				log.Println("[DEBUG] getAdapterConfig - Poll configuration is nil. No tags will be polled")
+			}
 		} else {
 			log.Println("[DEBUG] getAdapterConfig - No rows returned. Using defaults")
 		}
 	}
 }
 
-func publishModbusResponse(respJson map[string]interface{}) {
+func publishModbusResponse(response *modbusResponse) {
 	//Create the response topic
 	var theTopic string
-	if respJson["error"] != nil {
+	if response.Error != nil {
 		theTopic = topicRoot + "/error"
 	} else {
 		theTopic = topicRoot + "/response"
 	}
 
 	//Add a timestamp to the payload
-	respJson["timestamp"] = time.Now().Format(JavascriptISOString)
+	response.Timestamp = time.Now().Format(JavascriptISOString)
 
 	// TODO Add custom key for adapterID, defaulting to rail context, SiteID
 	if adapterID != "" {
-		respJson["SiteID"] = adapterID
+		response.SiteID = adapterID
 	}
 
-	respStr, err := json.Marshal(respJson)
+	respStr, err := json.Marshal(response)
 	if err != nil {
 		log.Printf("[ERROR] publishModbusResponse - ERROR marshalling json response: %s\n", err.Error())
 	} else {
@@ -587,27 +807,142 @@ func publishModbusResponse(respJson map[string]interface{}) {
 	}
 }
 
-func translateDataToModbusBytes(functionCode int, data []bool) []byte {
+// coilValues converts the Data of a coil write to coil states. Coils may be
+// written as booleans or as the numbers 0 and 1.
+func coilValues(data []interface{}) ([]bool, error) {
+	coils := make([]bool, len(data))
+	for ndx, value := range data {
+		switch v := value.(type) {
+		case bool:
+			coils[ndx] = v
+		case float64:
+			if v != 0 && v != 1 {
+				return nil, fmt.Errorf("Data[%d] must be a boolean, 0 or 1 for coil writes", ndx)
+			}
+			coils[ndx] = v == 1
+		default:
+			return nil, fmt.Errorf("Data[%d] must be a boolean, 0 or 1 for coil writes", ndx)
+		}
+	}
+	return coils, nil
+}
+
+func translateDataToModbusBytes(data []bool) []byte {
 	//We need to take the individual boolean values provided in the write multiple coils
 	//function code and create bytes according to the modbus spec.
-	var returnData []byte
-	var mask byte
+	//
+	//Each byte contains the values of 8 consecutive coils, with the first coil in the
+	//least significant bit. If the number of coils is not a multiple of 8, the unused
+	//high order bits of the last byte are set to zero.
+	returnData := make([]byte, (len(data)+7)/8)
 
 	for ndx, theBool := range data {
-		if ndx%8 == 0 {
-			if ndx > 0 {
-				returnData = append(returnData, mask)
-			}
-			mask = 0
+		if theBool {
+			returnData[ndx/8] |= 1 << uint(ndx%8)
+		}
+	}
+
+	return returnData
+}
+
+func translateModbusBytesToRegisters(modbusBytes []byte, addressCount uint16) []uint16 {
+	var data []uint16
+	for x := uint16(0); x < addressCount; x++ {
+		data = append(data, binary.BigEndian.Uint16(modbusBytes[x*2:(x*2)+2]))
+	}
+	return data
+}
+
+// validateWriteRegisterCount validates the number of registers encoded from the
+// Data of a register write against the limits of the function code and the
+// counts in the request. AddressCount defaults to the number of registers for
+// function code 16, as does WriteAddressCount for function code 23.
+func validateWriteRegisterCount(request *modbusRequest, registers int) error {
+	count := uint16(registers)
+	switch *request.FunctionCode {
+	case modbus.FuncCodeWriteSingleRegister:
+		if registers != 1 {
+			return fmt.Errorf("Data must contain a single register value for function code 6")
+		}
+	case modbus.FuncCodeWriteMultipleRegisters:
+		if registers > maxWriteRegisters {
+			return fmt.Errorf("Data exceeds the maximum of %d registers for function code 16", maxWriteRegisters)
+		}
+		if request.AddressCount == nil {
+			request.AddressCount = &count
+		} else if int(*request.AddressCount) != registers {
+			return fmt.Errorf("AddressCount must match the %d registers in Data", registers)
+		}
+	case modbus.FuncCodeReadWriteMultipleRegisters:
+		if registers > maxReadWriteRegisters {
+			return fmt.Errorf("Data exceeds the maximum of %d registers for function code 23", maxReadWriteRegisters)
 		}
-		mask = mask << 1
+		if request.WriteAddressCount == nil {
+			request.WriteAddressCount = &count
+		} else if int(*request.WriteAddressCount) != registers {
+			return fmt.Errorf("WriteAddressCount must match the %d registers in Data", registers)
+		}
+	}
+	return nil
+}
+
+// registerWriteData converts the Data of a register write to the bytes sent to
+// the modbus device. Values are encoded as 16 bit registers unless DataType or
+// DataTypes is provided, with any engineering unit scaling and the byte order
+// applied.
+func registerWriteData(request *modbusRequest, byteOrder string) ([]byte, error) {
+	values := request.Data
+	if len(values) == 0 {
+		return nil, fmt.Errorf("Data must be an array of register values")
+	}
 
-		if theBool == true {
-			mask = mask | 1
+	var scale *engineeringScale
+	if isScaled(request) {
+		requestedScale := requestScale(request)
+		scale = &requestedScale
+	}
+
+	if request.DataType != "" || request.DataTypes != nil {
+		dataTypes, err := writeDataTypes(request, len(values))
+		if err != nil {
+			return nil, err
 		}
+		format := requestRegisterFormat(request)
+		format.byteOrder = byteOrder
+		return translateValuesToRegisters(values, dataTypes, format, scale)
 	}
 
-	return returnData
+	if scale != nil {
+		raw, err := unscaleRegisterData(values, *scale)
+		if err != nil {
+			return nil, err
+		}
+		values = raw
+	}
+
+	writeData, err := translateRegistersToModbusBytes(values)
+	if err != nil {
+		return nil, err
+	}
+	return reorderRegisterBytes(writeData, 1, byteOrder), nil
+}
+
+func translateRegistersToModbusBytes(values []interface{}) ([]byte, error) {
+	//We need to take the register values provided in the request and create the
+	//big endian byte sequence sent to the modbus device
+	if len(values) == 0 {
+		return nil, fmt.Errorf("Data must be an array of register values")
+	}
+
+	returnData := make([]byte, len(values)*2)
+	for ndx, value := range values {
+		if !isIntegerInRange(value, 0, 0xFFFF) {
+			return nil, fmt.Errorf("Invalid register value %v, register values must be integers between 0 and 65535", value)
+		}
+		binary.BigEndian.PutUint16(returnData[ndx*2:], uint16(value.(float64)))
+	}
+
+	return returnData, nil
 }
 
 func translateModbusBytesToData(modbusBytes []byte, addressCount uint16) []bool {
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestCoilValues(t *testing.T) {
+	tests := []struct {
+		data []interface{}
+		want []bool
+		err  string
+	}{
+		{[]interface{}{true, false, true}, []bool{true, false, true}, ""},
+		{[]interface{}{1.0, 0.0, 1.0}, []bool{true, false, true}, ""},
+		{[]interface{}{true, 0.0, 1.0, false}, []bool{true, false, true, false}, ""},
+		{[]interface{}{}, []bool{}, ""},
+		{[]interface{}{true, 2.0}, nil, "Data[1] must be a boolean, 0 or 1 for coil writes"},
+		{[]interface{}{0.5}, nil, "Data[0] must be a boolean, 0 or 1 for coil writes"},
+		{[]interface{}{-1.0}, nil, "Data[0] must be a boolean, 0 or 1 for coil writes"},
+		{[]interface{}{false, true, "x"}, nil, "Data[2] must be a boolean, 0 or 1 for coil writes"},
+		{[]interface{}{nil}, nil, "Data[0] must be a boolean, 0 or 1 for coil writes"},
+	}
+
+	for _, test := range tests {
+		got, err := coilValues(test.data)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("coilValues(%v) error = %v, want %q", test.data, err, test.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("coilValues(%v) = %v, %v, want %v", test.data, got, err, test.want)
+		}
+	}
+}
+
+func TestTranslateDataToModbusBytes(t *testing.T) {
+	tests := []struct {
+		data []bool
+		want []byte
+	}{
+		{[]bool{}, []byte{}},
+		{[]bool{true}, []byte{0x01}},
+		{[]bool{false, true}, []byte{0x02}},
+		{[]bool{true, false, true, true, false, false, true, true}, []byte{0xCD}},
+		{[]bool{true, false, true, true, false, false, true, true, true}, []byte{0xCD, 0x01}},
+		{[]bool{false, false, false, false, false, false, false, false, false, true}, []byte{0x00, 0x02}},
+		//The example from the write multiple coils function code in the modbus spec
+		{[]bool{true, false, true, true, false, false, true, true, true, false}, []byte{0xCD, 0x01}},
+	}
+
+	for _, test := range tests {
+		if got := translateDataToModbusBytes(test.data); !bytes.Equal(got, test.want) {
+			t.Errorf("translateDataToModbusBytes(%v) = % x, want % x", test.data, got, test.want)
+		}
+	}
+}
+
+func TestCoilBytesRoundTrip(t *testing.T) {
+	//Every count from a single coil to just over two bytes, so each partial last
+	//byte is covered
+	for count := 1; count <= 17; count++ {
+		for _, pattern := range []func(int) bool{
+			func(ndx int) bool { return true },
+			func(ndx int) bool { return ndx%2 == 0 },
+			func(ndx int) bool { return ndx%3 == 1 },
+			func(ndx int) bool { return ndx == count-1 },
+		} {
+			coils := make([]bool, count)
+			for ndx := range coils {
+				coils[ndx] = pattern(ndx)
+			}
+
+			modbusBytes := translateDataToModbusBytes(coils)
+			if len(modbusBytes) != (count+7)/8 {
+				t.Errorf("translateDataToModbusBytes(%v) returned %d bytes, want %d", coils, len(modbusBytes), (count+7)/8)
+				continue
+			}
+			if unused := modbusBytes[len(modbusBytes)-1] >> uint((count-1)%8+1); unused != 0 {
+				t.Errorf("translateDataToModbusBytes(%v) = % x, unused bits are not zero", coils, modbusBytes)
+			}
+			if got := translateModbusBytesToData(modbusBytes, uint16(count)); !reflect.DeepEqual(got, coils) {
+				t.Errorf("translateModbusBytesToData(% x, %d) = %v, want %v", modbusBytes, count, got, coils)
+			}
+		}
+	}
+}
+
+func TestTranslateModbusBytesToData(t *testing.T) {
+	tests := []struct {
+		modbusBytes  []byte
+		addressCount uint16
+		want         []bool
+	}{
+		{[]byte{0x01}, 1, []bool{true}},
+		{[]byte{0xCD}, 8, []bool{true, false, true, true, false, false, true, true}},
+		{[]byte{0xCD, 0x01}, 10, []bool{true, false, true, true, false, false, true, true, true, false}},
+		//Bits beyond the address count are ignored
+		{[]byte{0xFF}, 3, []bool{true, true, true}},
+	}
+
+	for _, test := range tests {
+		if got := translateModbusBytesToData(test.modbusBytes, test.addressCount); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("translateModbusBytesToData(% x, %d) = %v, want %v", test.modbusBytes, test.addressCount, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// outbox stores the messages that could not be published, nil when store and
+// forward is disabled
+var outbox *outboundQueue
+
+// storedMessage is a message waiting to be published, as stored on disk
+type storedMessage struct {
+	Topic    string
+	Payload  string
+	Captured time.Time
+}
+
+// storedEntry describes a stored message without its payload
+type storedEntry struct {
+	sequence uint64
+	size     int64
+	captured time.Time
+}
+
+// outboundQueue is a disk backed queue of messages that could not be published
+// while the broker was unreachable. Each message is stored in its own file, named
+// by sequence number, so that messages survive a restart of the adapter and are
+// delivered in the order they were captured. The queue is bounded by the total
+// size of the stored messages and by their age, with the oldest messages dropped
+// first.
+type outboundQueue struct {
+	mu         sync.Mutex
+	directory  string
+	maxBytes   int64
+	maxAge     time.Duration
+	entries    []storedEntry
+	size       int64
+	sequence   uint64
+	forwarding int32 //1 while stored messages are being delivered
+	dropped    uint64
+	send       func(topic string, payload []byte) error
+}
+
+// newOutboundQueue opens the queue stored in the directory, creating the directory
+// if necessary, and loads any messages left from a previous run of the adapter
+func newOutboundQueue(directory string, maxBytes int64, maxAge time.Duration) (*outboundQueue, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &outboundQueue{
+		directory: directory,
+		maxBytes:  maxBytes,
+		maxAge:    maxAge,
+		send:      publishStoredMessage,
+	}
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			//A message that was being stored when the adapter stopped
+			os.Remove(filepath.Join(directory, name))
+			continue
+		}
+		sequence, err := strconv.ParseUint(strings.TrimSuffix(name, ".json"), 10, 64)
+		if err != nil || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		message, err := q.read(sequence)
+		if err != nil {
+			log.Printf("[WARN] newOutboundQueue - Discarding unreadable stored message %s: %s\n", name, err.Error())
+			os.Remove(filepath.Join(directory, name))
+			continue
+		}
+		q.entries = append(q.entries, storedEntry{sequence: sequence, size: file.Size(), captured: message.Captured})
+		q.size += file.Size()
+		if sequence >= q.sequence {
+			q.sequence = sequence + 1
+		}
+	}
+	sort.Slice(q.entries, func(i, j int) bool { return q.entries[i].sequence < q.entries[j].sequence })
+
+	q.mu.Lock()
+	q.prune(0)
+	q.mu.Unlock()
+	log.Printf("[INFO] newOutboundQueue - %d stored message(s) loaded from %s\n", len(q.entries), directory)
+	return q, nil
+}
+
+// add stores a message to be published later
+func (q *outboundQueue) add(topic string, payload string, captured time.Time) error {
+	messageJSON, err := json.Marshal(storedMessage{Topic: topic, Payload: payload, Captured: captured})
+	if err != nil {
+		return err
+	}
+	size := int64(len(messageJSON))
+	if size > q.maxBytes {
+		atomic.AddUint64(&q.dropped, 1)
+		return fmt.Errorf("message of %d bytes is larger than the outbox", size)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	//Make room for the message, dropping the oldest messages
+	q.prune(size)
+
+	//Write to a temporary file first, so that a partially written message is never replayed
+	path := q.path(q.sequence)
+	if err := ioutil.WriteFile(path+".tmp", messageJSON, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+
+	q.entries = append(q.entries, storedEntry{sequence: q.sequence, size: size, captured: captured})
+	q.size += size
+	q.sequence++
+	return nil
+}
+
+// prune drops the messages older than the maximum age, and then the oldest
+// messages until a message of the specified size can be stored. The caller must
+// hold the lock.
+func (q *outboundQueue) prune(size int64) {
+	for len(q.entries) > 0 {
+		entry := q.entries[0]
+		expired := q.maxAge > 0 && time.Since(entry.captured) > q.maxAge
+		if !expired && q.size+size <= q.maxBytes {
+			return
+		}
+		if expired {
+			log.Printf("[WARN] outboundQueue.prune - Dropping stored message %d captured at %s, it is older than %s\n", entry.sequence, entry.captured.Format(JavascriptISOString), q.maxAge)
+		} else {
+			log.Printf("[WARN] outboundQueue.prune - Dropping stored message %d captured at %s, the outbox is full\n", entry.sequence, entry.captured.Format(JavascriptISOString))
+		}
+		q.remove(entry)
+		atomic.AddUint64(&q.dropped, 1)
+	}
+}
+
+// remove deletes the oldest stored message. The caller must hold the lock.
+func (q *outboundQueue) remove(entry storedEntry) {
+	if err := os.Remove(q.path(entry.sequence)); err != nil && !os.IsNotExist(err) {
+		log.Printf("[ERROR] outboundQueue.remove - Unable to remove stored message %d: %s\n", entry.sequence, err.Error())
+	}
+	q.entries = q.entries[1:]
+	q.size -= entry.size
+}
+
+// pending returns the number of stored messages
+func (q *outboundQueue) pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+// forward delivers the stored messages in the background, unless they are
+// already being delivered
+func (q *outboundQueue) forward() {
+	if !atomic.CompareAndSwapInt32(&q.forwarding, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&q.forwarding, 0)
+		q.replay()
+	}()
+}
+
+// replay publishes the stored messages in the order they were captured, removing
+// each message once it has been published. Replay stops at the first message
+// that cannot be published, which is retried later.
+func (q *outboundQueue) replay() {
+	delivered := 0
+	for {
+		q.mu.Lock()
+		q.prune(0)
+		if len(q.entries) == 0 {
+			q.mu.Unlock()
+			break
+		}
+		entry := q.entries[0]
+		q.mu.Unlock()
+
+		message, err := q.read(entry.sequence)
+		if err != nil {
+			log.Printf("[ERROR] outboundQueue.replay - Discarding unreadable stored message %d: %s\n", entry.sequence, err.Error())
+		} else if err = q.send(message.Topic, []byte(message.Payload)); err != nil {
+			log.Printf("[WARN] outboundQueue.replay - Unable to publish stored message to topic %s, will retry: %s\n", message.Topic, err.Error())
+			break
+		} else {
+			delivered++
+		}
+
+		q.mu.Lock()
+		//The message may have been pruned while it was being published
+		if len(q.entries) > 0 && q.entries[0].sequence == entry.sequence {
+			q.remove(entry)
+		}
+		q.mu.Unlock()
+	}
+
+	if delivered > 0 {
+		log.Printf("[INFO] outboundQueue.replay - %d stored message(s) published, %d remaining\n", delivered, q.pending())
+	}
+}
+
+// publishStoredMessage publishes a stored message to the broker
+func publishStoredMessage(topic string, payload []byte) error {
+	return cbBroker.client.Publish(topic, payload, cbBroker.qos)
+}
+
+// read reads a stored message from disk
+func (q *outboundQueue) read(sequence uint64) (*storedMessage, error) {
+	messageJSON, err := ioutil.ReadFile(q.path(sequence))
+	if err != nil {
+		return nil, err
+	}
+	message := &storedMessage{}
+	if err := json.Unmarshal(messageJSON, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// path returns the path of the file containing a stored message
+func (q *outboundQueue) path(sequence uint64) string {
+	return filepath.Join(q.directory, fmt.Sprintf("%020d.json", sequence))
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storedPayloads returns the payloads of the stored messages, in order
+func storedPayloads(t *testing.T, q *outboundQueue) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	payloads := []string{}
+	for _, entry := range q.entries {
+		message, err := q.read(entry.sequence)
+		if err != nil {
+			t.Fatalf("read(%d) returned error: %s", entry.sequence, err)
+		}
+		payloads = append(payloads, message.Payload)
+	}
+	return payloads
+}
+
+func TestOutboundQueuePrunesBySize(t *testing.T) {
+	//Each message is stored as 100 bytes of json
+	payload := func(ndx int) string { return fmt.Sprintf("%s%d", strings.Repeat("x", 37), ndx) }
+
+	q, err := newOutboundQueue(t.TempDir(), 350, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	captured := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for ndx := 0; ndx < 5; ndx++ {
+		if err := q.add("data", payload(ndx), captured); err != nil {
+			t.Fatalf("add returned error: %s", err)
+		}
+	}
+
+	if want := []string{payload(2), payload(3), payload(4)}; !reflect.DeepEqual(storedPayloads(t, q), want) {
+		t.Errorf("stored messages = %v, want %v", storedPayloads(t, q), want)
+	}
+	if q.size > q.maxBytes || q.dropped != 2 {
+		t.Errorf("size = %d, dropped = %d, want at most %d bytes and 2 dropped", q.size, q.dropped, q.maxBytes)
+	}
+
+	if err := q.add("data", strings.Repeat("x", 400), captured); err == nil {
+		t.Error("add of a message larger than the outbox did not return an error")
+	}
+	if q.pending() != 3 || q.dropped != 3 {
+		t.Errorf("pending = %d, dropped = %d after a message larger than the outbox, want 3 and 3", q.pending(), q.dropped)
+	}
+}
+
+func TestOutboundQueuePrunesByAge(t *testing.T) {
+	q, err := newOutboundQueue(t.TempDir(), 1<<20, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	q.add("data", "old", now.Add(-2*time.Minute))
+	q.add("data", "recent", now.Add(-30*time.Second))
+	q.add("data", "new", now)
+
+	if want := []string{"recent", "new"}; !reflect.DeepEqual(storedPayloads(t, q), want) {
+		t.Errorf("stored messages = %v, want %v", storedPayloads(t, q), want)
+	}
+	if q.dropped != 1 {
+		t.Errorf("dropped = %d, want 1", q.dropped)
+	}
+}
+
+func TestOutboundQueueReplaysInOrder(t *testing.T) {
+	directory := t.TempDir()
+	q, err := newOutboundQueue(directory, 1<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var published []string
+	brokerDown := true
+	q.send = func(topic string, payload []byte) error {
+		if brokerDown {
+			return fmt.Errorf("not connected")
+		}
+		published = append(published, topic+" "+string(payload))
+		return nil
+	}
+
+	for ndx := 0; ndx < 3; ndx++ {
+		q.add(fmt.Sprintf("data/%d", ndx), fmt.Sprintf("%d", ndx), time.Now())
+	}
+
+	//Messages are kept when they cannot be published
+	q.replay()
+	if q.pending() != 3 || len(published) != 0 {
+		t.Fatalf("pending = %d, published = %v while the broker is down", q.pending(), published)
+	}
+
+	brokerDown = false
+	q.replay()
+	if want := []string{"data/0 0", "data/1 1", "data/2 2"}; !reflect.DeepEqual(published, want) {
+		t.Errorf("published = %v, want %v", published, want)
+	}
+	if q.pending() != 0 {
+		t.Errorf("pending = %d after replay, want 0", q.pending())
+	}
+	if files, _ := ioutil.ReadDir(directory); len(files) != 0 {
+		t.Errorf("%d file(s) left in the outbox after replay", len(files))
+	}
+}
+
+func TestOutboundQueueReplayStopsAtFailure(t *testing.T) {
+	q, err := newOutboundQueue(t.TempDir(), 1<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var published []string
+	q.send = func(topic string, payload []byte) error {
+		if len(published) == 1 {
+			return fmt.Errorf("not connected")
+		}
+		published = append(published, string(payload))
+		return nil
+	}
+	for _, payload := range []string{"a", "b", "c"} {
+		q.add("data", payload, time.Now())
+	}
+
+	q.replay()
+	if want := []string{"b", "c"}; !reflect.DeepEqual(storedPayloads(t, q), want) {
+		t.Errorf("stored messages = %v after a failed publish, want %v", storedPayloads(t, q), want)
+	}
+}
+
+func TestOutboundQueueReload(t *testing.T) {
+	directory := t.TempDir()
+	q, err := newOutboundQueue(directory, 1<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	captured := time.Now().Add(-time.Minute).Round(time.Millisecond)
+	for _, payload := range []string{"a", "b", "c"} {
+		q.add("data", payload, captured)
+	}
+
+	//A partially written message, an unreadable message and an unrelated file
+	ioutil.WriteFile(filepath.Join(directory, fmt.Sprintf("%020d.json.tmp", 3)), []byte(`{"Topic":`), 0644)
+	ioutil.WriteFile(filepath.Join(directory, fmt.Sprintf("%020d.json", 1000)), []byte(`{"Topic":`), 0644)
+	ioutil.WriteFile(filepath.Join(directory, "notes.txt"), []byte("notes"), 0644)
+
+	reloaded, err := newOutboundQueue(directory, 1<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(storedPayloads(t, reloaded), want) {
+		t.Errorf("reloaded messages = %v, want %v", storedPayloads(t, reloaded), want)
+	}
+	if reloaded.size != q.size || reloaded.sequence != q.sequence {
+		t.Errorf("reloaded size = %d, sequence = %d, want %d and %d", reloaded.size, reloaded.sequence, q.size, q.sequence)
+	}
+	if message, err := reloaded.read(reloaded.entries[0].sequence); err != nil || !message.Captured.Equal(captured) {
+		t.Errorf("reloaded message = %+v, %v, want captured at %s", message, err, captured)
+	}
+
+	//New messages are stored behind the reloaded messages
+	reloaded.add("data", "d", time.Now())
+	if want := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(storedPayloads(t, reloaded), want) {
+		t.Errorf("stored messages = %v, want %v", storedPayloads(t, reloaded), want)
+	}
+
+	//Messages older than the maximum age are dropped when the outbox is reloaded
+	expired, err := newOutboundQueue(directory, 1<<20, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"d"}; !reflect.DeepEqual(storedPayloads(t, expired), want) {
+		t.Errorf("messages reloaded with a shorter maximum age = %v, want %v", storedPayloads(t, expired), want)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	modbus "github.com/goburrow/modbus"
+)
+
+// sendPDU sends a request PDU to the modbus device using the framing of the
+// handler and returns the response PDU. It is used for the function codes that
+// are not implemented by modbus.Client.
+func sendPDU(handler modbusClientHandler, request *modbus.ProtocolDataUnit) (*modbus.ProtocolDataUnit, error) {
+	response, err := exchangePDU(handler, request)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Data) == 0 {
+		return nil, fmt.Errorf("modbus: response data is empty")
+	}
+	return response, nil
+}
+
+// exchangePDU sends a request PDU and returns the response PDU, which may be
+// empty. Exception responses are returned as a *modbus.ModbusError.
+func exchangePDU(handler modbusClientHandler, request *modbus.ProtocolDataUnit) (*modbus.ProtocolDataUnit, error) {
+	aduRequest, err := handler.Encode(request)
+	if err != nil {
+		return nil, err
+	}
+	aduResponse, err := handler.Send(aduRequest)
+	if err != nil {
+		return nil, err
+	}
+	if err = handler.Verify(aduRequest, aduResponse); err != nil {
+		return nil, err
+	}
+	response, err := handler.Decode(aduResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	//An exception response has the high bit of the function code set
+	if response.FunctionCode != request.FunctionCode {
+		modbusErr := &modbus.ModbusError{FunctionCode: response.FunctionCode}
+		if len(response.Data) > 0 {
+			modbusErr.ExceptionCode = response.Data[0]
+		}
+		return nil, modbusErr
+	}
+	return response, nil
+}
+
+// readFIFOQueue reads the FIFO queue at the specified pointer address and returns
+// the registers in the queue
+//
+// Request:
+//
+//	Function code         : 1 byte (0x18)
+//	FIFO pointer address  : 2 bytes
+//
+// Response:
+//
+//	Function code         : 1 byte (0x18)
+//	Byte count            : 2 bytes
+//	FIFO count            : 2 bytes (<=31)
+//	FIFO value register   : Nx2 bytes
+func readFIFOQueue(handler modbusClientHandler, address uint16) ([]uint16, error) {
+	request := &modbus.ProtocolDataUnit{
+		FunctionCode: modbus.FuncCodeReadFIFOQueue,
+		Data:         []byte{byte(address >> 8), byte(address)},
+	}
+	response, err := sendPDU(handler, request)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(response.Data) < 4 {
+		return nil, fmt.Errorf("modbus: response data size '%v' is less than expected '%v'", len(response.Data), 4)
+	}
+	byteCount := int(binary.BigEndian.Uint16(response.Data))
+	if byteCount != len(response.Data)-2 {
+		return nil, fmt.Errorf("modbus: response data size '%v' does not match count '%v'", len(response.Data)-2, byteCount)
+	}
+	fifoCount := int(binary.BigEndian.Uint16(response.Data[2:]))
+	if fifoCount > 31 {
+		return nil, fmt.Errorf("modbus: fifo count '%v' is greater than expected '%v'", fifoCount, 31)
+	}
+	if fifoCount*2 != len(response.Data)-4 {
+		return nil, fmt.Errorf("modbus: fifo count '%v' does not match response data size '%v'", fifoCount, len(response.Data)-4)
+	}
+
+	values := make([]uint16, fifoCount)
+	for ndx := range values {
+		values[ndx] = binary.BigEndian.Uint16(response.Data[4+ndx*2:])
+	}
+	return values, nil
+}
+
+const (
+	funcCodeEncapsulatedInterface = 43
+	meiTypeReadDeviceID           = 0x0E
+
+	readDeviceIDBasic      = 1
+	readDeviceIDRegular    = 2
+	readDeviceIDExtended   = 3
+	readDeviceIDIndividual = 4
+)
+
+// deviceIDObjectNames are the names of the standard device identification objects
+var deviceIDObjectNames = map[byte]string{
+	0x00: "VendorName",
+	0x01: "ProductCode",
+	0x02: "MajorMinorRevision",
+	0x03: "VendorUrl",
+	0x04: "ProductName",
+	0x05: "ModelName",
+	0x06: "UserApplicationName",
+}
+
+// deviceIDObjectName returns the name used for a device identification object in
+// responses. Private objects are named by id, e.g. Object0x80.
+func deviceIDObjectName(objectID byte) string {
+	if name, ok := deviceIDObjectNames[objectID]; ok {
+		return name
+	}
+	return fmt.Sprintf("Object0x%02X", objectID)
+}
+
+// readDeviceIdentification reads the device identification objects for the access
+// type specified by readDeviceIDCode, starting at objectID. When the device cannot
+// fit every object in a single response, further requests are issued until all
+// objects have been read. The conformity level reported by the device is returned
+// along with the objects.
+//
+// Request:
+//
+//	Function code         : 1 byte (0x2B)
+//	MEI type              : 1 byte (0x0E)
+//	Read device id code   : 1 byte
+//	Object id             : 1 byte
+//
+// Response:
+//
+//	Function code         : 1 byte (0x2B)
+//	MEI type              : 1 byte (0x0E)
+//	Read device id code   : 1 byte
+//	Conformity level      : 1 byte
+//	More follows          : 1 byte
+//	Next object id        : 1 byte
+//	Number of objects     : 1 byte
+//	Objects               : object id (1 byte), length (1 byte), value (N bytes)
+func readDeviceIdentification(handler modbusClientHandler, readDeviceIDCode byte, objectID byte) (map[string]string, byte, error) {
+	objects := make(map[string]string)
+	var conformityLevel byte
+
+	//A device can return at most 256 objects, which bounds the number of transactions
+	for transaction := 0; transaction < 256; transaction++ {
+		request := &modbus.ProtocolDataUnit{
+			FunctionCode: funcCodeEncapsulatedInterface,
+			Data:         []byte{meiTypeReadDeviceID, readDeviceIDCode, objectID},
+		}
+		response, err := sendPDU(handler, request)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		data := response.Data
+		if len(data) < 6 {
+			return nil, 0, fmt.Errorf("modbus: response data size '%v' is less than expected '%v'", len(data), 6)
+		}
+		if data[0] != meiTypeReadDeviceID {
+			return nil, 0, fmt.Errorf("modbus: response MEI type '%v' does not match request '%v'", data[0], meiTypeReadDeviceID)
+		}
+
+		conformityLevel = data[2]
+		moreFollows := data[3] == 0xFF
+		nextObjectID := data[4]
+		numberOfObjects := int(data[5])
+
+		offset := 6
+		for ndx := 0; ndx < numberOfObjects; ndx++ {
+			if offset+2 > len(data) {
+				return nil, 0, fmt.Errorf("modbus: response truncated in object '%v'", ndx)
+			}
+			id := data[offset]
+			length := int(data[offset+1])
+			offset += 2
+			if offset+length > len(data) {
+				return nil, 0, fmt.Errorf("modbus: response truncated in object '%v'", id)
+			}
+			objects[deviceIDObjectName(id)] = string(data[offset : offset+length])
+			offset += length
+		}
+
+		if !moreFollows || readDeviceIDCode == readDeviceIDIndividual {
+			return objects, conformityLevel, nil
+		}
+		objectID = nextObjectID
+	}
+
+	return nil, 0, fmt.Errorf("modbus: device identification did not complete")
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	modbus "github.com/goburrow/modbus"
+)
+
+// pduResponder is a modbus TCP handler that answers every request with a canned
+// response PDU, without connecting to a device
+type pduResponder struct {
+	*modbus.TCPClientHandler
+	response []byte
+}
+
+func newPDUResponder(response ...byte) *pduResponder {
+	return &pduResponder{TCPClientHandler: modbus.NewTCPClientHandler("localhost:502"), response: response}
+}
+
+func (handler *pduResponder) Send(aduRequest []byte) ([]byte, error) {
+	//The MBAP header of the request, with the length of the response
+	aduResponse := append([]byte{}, aduRequest[:7]...)
+	binary.BigEndian.PutUint16(aduResponse[4:], uint16(1+len(handler.response)))
+	return append(aduResponse, handler.response...), nil
+}
+
+func TestReadFIFOQueue(t *testing.T) {
+	tests := []struct {
+		name     string
+		response []byte
+		want     []uint16
+		err      string
+	}{
+		{"two values", []byte{24, 0, 6, 0, 2, 0x01, 0xB8, 0x12, 0x84}, []uint16{0x01B8, 0x1284}, ""},
+		{"empty queue", []byte{24, 0, 2, 0, 0}, []uint16{}, ""},
+		{"exception", []byte{24 | 0x80, 2}, nil, "modbus: exception '2' (illegal data address), function '152'"},
+		{"short response", []byte{24, 0, 2, 0}, nil, "modbus: response data size '3' is less than expected '4'"},
+		{"byte count mismatch", []byte{24, 0, 8, 0, 2, 0x01, 0xB8, 0x12, 0x84}, nil, "modbus: response data size '6' does not match count '8'"},
+		{"fifo count mismatch", []byte{24, 0, 6, 0, 3, 0x01, 0xB8, 0x12, 0x84}, nil, "modbus: fifo count '3' does not match response data size '4'"},
+		{"fifo count too large", []byte{24, 0, 2, 0, 32}, nil, "modbus: fifo count '32' is greater than expected '31'"},
+	}
+
+	for _, test := range tests {
+		values, err := readFIFOQueue(newPDUResponder(test.response...), 0x04DE)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: readFIFOQueue error = %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(values, test.want) {
+			t.Errorf("%s: readFIFOQueue = %v, %v, want %v", test.name, values, err, test.want)
+		}
+	}
+}
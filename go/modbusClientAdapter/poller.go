@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	modbus "github.com/goburrow/modbus"
+)
+
+const (
+	qualityGood = "good"
+	qualityBad  = "bad"
+)
+
+// pollGroups contains the groups of tags polled by the adapter. They are loaded
+// from the poll_config column of the adapter configuration collection at startup.
+var pollGroups []*pollGroup
+
+// pollGroup is a set of devices whose tags are read at the same interval
+type pollGroup struct {
+	name     string
+	interval time.Duration
+	devices  []*pollDevice
+}
+
+// pollDevice is the unit on a modbus host that a group of tags is read from. A
+// device is polled by the worker of its modbus host, one cycle at a time. Its tags
+// are read with the blocks they have been coalesced into.
+type pollDevice struct {
+	group  string
+	host   string
+	unitID *uint8
+	tags   []*pollTag
+	blocks []*readBlock
+	busy   int32 //1 while a poll cycle is queued or running
+}
+
+// pollTag is a named value read from a device with a validated read request. The
+// value last published for the tag is only accessed by the poll cycles of its
+// device, which do not overlap.
+type pollTag struct {
+	name    string
+	request *modbusRequest
+	policy  reportPolicy
+	last    *tagReport
+}
+
+// tagValue is the value of a tag read during a poll cycle
+type tagValue struct {
+	Name    string         `json:"Name"`
+	Value   interface{}    `json:"Value,omitempty"`
+	Units   string         `json:"Units,omitempty"`
+	Quality string         `json:"Quality"`
+	Error   *responseError `json:"Error,omitempty"`
+}
+
+// pollData is the message published to {topicRoot}/data after each poll cycle
+type pollData struct {
+	Group      string     `json:"Group"`
+	ModbusHost string     `json:"ModbusHost"`
+	UnitID     *uint8     `json:"UnitID,omitempty"`
+	Tags       []tagValue `json:"Tags"`
+	Timestamp  string     `json:"timestamp"`
+	SiteID     string     `json:"SiteID,omitempty"`
+}
+
+// pollConfig is the json structure of the poll_config adapter configuration
+type pollConfig struct {
+	Groups []struct {
+		Name     string
+		Interval float64
+		MaxGap   uint16
+		Devices  []map[string]json.RawMessage
+		reportConfig
+	}
+}
+
+// pollTagFunctionCodes are the function codes that may be used to read tags
+var pollTagFunctionCodes = map[uint8]bool{
+	modbus.FuncCodeReadCoils:            true,
+	modbus.FuncCodeReadDiscreteInputs:   true,
+	modbus.FuncCodeReadHoldingRegisters: true,
+	modbus.FuncCodeReadInputRegisters:   true,
+}
+
+// loadPollConfig parses the poll_config adapter configuration, which is a json
+// object (or a string containing one) listing the groups of tags to poll, e.g.
+//
+//	{"Groups": [{"Name": "fast", "Interval": 5, "Devices": [
+//	  {"ModbusHost": "192.168.0.9:502", "UnitID": 1, "Tags": [
+//	    {"Name": "Pressure", "FunctionCode": 3, "StartAddress": 100, "DataType": "float32"}]}]}]}
+//
+// The fields of a device other than Tags are request defaults for its tags. Each
+// tag, combined with the defaults of its device and the device profile of its
+// modbus host, must be a valid read request. The tags of a device are coalesced
+// into block reads, merging tags separated by at most MaxGap unused addresses.
+// The report fields of a group are defaults for the report fields of its tags.
+func loadPollConfig(config interface{}) error {
+	configJSON, ok := config.(string)
+	if !ok {
+		marshalled, err := json.Marshal(config)
+		if err != nil {
+			return fmt.Errorf("poll_config could not be read: %s", err.Error())
+		}
+		configJSON = string(marshalled)
+	}
+
+	parsed := pollConfig{}
+	if err := strictUnmarshal([]byte(configJSON), &parsed); err != nil {
+		return fmt.Errorf("poll_config is invalid: %s", err.Error())
+	}
+
+	groups := make([]*pollGroup, 0, len(parsed.Groups))
+	groupNames := make(map[string]bool)
+	for _, groupConfig := range parsed.Groups {
+		if groupConfig.Name == "" {
+			return fmt.Errorf("Every poll group must have a Name")
+		}
+		if groupNames[groupConfig.Name] {
+			return fmt.Errorf("Poll group %s is specified more than once", groupConfig.Name)
+		}
+		groupNames[groupConfig.Name] = true
+		if groupConfig.Interval <= 0 {
+			return fmt.Errorf("Interval of poll group %s must be a number of seconds greater than 0", groupConfig.Name)
+		}
+		if err := groupConfig.reportConfig.validate(); err != nil {
+			return fmt.Errorf("Poll group %s: %s", groupConfig.Name, err.Error())
+		}
+
+		group := &pollGroup{
+			name:     groupConfig.Name,
+			interval: time.Duration(groupConfig.Interval * float64(time.Second)),
+		}
+		for _, deviceConfig := range groupConfig.Devices {
+			device, err := parsePollDevice(group.name, groupConfig.reportConfig, deviceConfig)
+			if err != nil {
+				return fmt.Errorf("Poll group %s: %s", group.name, err.Error())
+			}
+			device.blocks = coalesceTags(device.tags, groupConfig.MaxGap)
+			log.Printf("[DEBUG] loadPollConfig - %d tag(s) of %s in group %s coalesced into %d read(s)\n", len(device.tags), device.host, group.name, len(device.blocks))
+			group.devices = append(group.devices, device)
+		}
+		groups = append(groups, group)
+	}
+
+	pollGroups = groups
+	log.Printf("[DEBUG] loadPollConfig - %d poll group(s) loaded\n", len(pollGroups))
+	return nil
+}
+
+// parsePollDevice parses a device of a poll group and the tags read from it
+func parsePollDevice(group string, reportDefaults reportConfig, config map[string]json.RawMessage) (*pollDevice, error) {
+	defaults := make(map[string]json.RawMessage, len(config))
+	for field, value := range config {
+		defaults[field] = value
+	}
+	delete(defaults, "Tags")
+
+	//The device fields are decoded as a request, which validates them and applies the device profile
+	deviceJSON, _ := json.Marshal(defaults)
+	deviceRequest, err := decodeRequest(deviceJSON)
+	if err != nil {
+		return nil, err
+	}
+	if deviceRequest.ModbusHost == "" {
+		return nil, fmt.Errorf("Every device must have a ModbusHost")
+	}
+	if _, err := parseModbusHost(deviceRequest.ModbusHost); err != nil {
+		return nil, err
+	}
+
+	var tagConfigs []map[string]json.RawMessage
+	if err := strictUnmarshal(config["Tags"], &tagConfigs); err != nil || len(tagConfigs) == 0 {
+		return nil, fmt.Errorf("Tags of device %s must be a non-empty array of objects", deviceRequest.ModbusHost)
+	}
+
+	device := &pollDevice{
+		group:  group,
+		host:   deviceRequest.ModbusHost,
+		unitID: deviceRequest.UnitID,
+	}
+	tagNames := make(map[string]bool)
+	for _, tagConfig := range tagConfigs {
+		tag, err := parsePollTag(defaults, reportDefaults, tagConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Device %s: %s", device.host, err.Error())
+		}
+		if tagNames[tag.name] {
+			return nil, fmt.Errorf("Device %s: Tag %s is specified more than once", device.host, tag.name)
+		}
+		tagNames[tag.name] = true
+		device.tags = append(device.tags, tag)
+	}
+	return device, nil
+}
+
+// parsePollTag combines a tag with the defaults of its device and validates it as
+// a read request
+func parsePollTag(defaults map[string]json.RawMessage, reportDefaults reportConfig, config map[string]json.RawMessage) (*pollTag, error) {
+	var name string
+	if err := json.Unmarshal(config["Name"], &name); err != nil || name == "" {
+		return nil, fmt.Errorf("Every tag must have a Name")
+	}
+	if config["ModbusHost"] != nil || config["UnitID"] != nil {
+		return nil, fmt.Errorf("Tag %s must not specify ModbusHost or UnitID, they are specified by the device", name)
+	}
+
+	fields := make(map[string]json.RawMessage, len(defaults)+len(config))
+	for field, value := range defaults {
+		fields[field] = value
+	}
+	for field, value := range config {
+		fields[field] = value
+	}
+	delete(fields, "Name")
+
+	report, err := parseReportConfig(fields)
+	if err != nil {
+		return nil, fmt.Errorf("Tag %s: %s", name, err.Error())
+	}
+
+	requestJSON, _ := json.Marshal(fields)
+	request, err := decodeRequest(requestJSON)
+	if err == nil {
+		err = validateRequest(request)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Tag %s: %s", name, err.Error())
+	}
+	if !pollTagFunctionCodes[*request.FunctionCode] {
+		return nil, fmt.Errorf("Tag %s: FunctionCode must be 1, 2, 3 or 4", name)
+	}
+	if request.RawPDU != nil {
+		return nil, fmt.Errorf("Tag %s: RawPDU cannot be used for tags", name)
+	}
+
+	return &pollTag{name: name, request: request, policy: report.reportPolicy(reportDefaults)}, nil
+}
+
+// poller reads the tags of each poll group at the interval of the group
+type poller struct {
+	groups     []*pollGroup
+	dispatcher *requestDispatcher
+	stopped    chan struct{}
+	running    sync.WaitGroup
+}
+
+// startPoller starts polling each group, queueing the poll cycles of its devices
+// on the dispatcher
+func startPoller(groups []*pollGroup, dispatcher *requestDispatcher) *poller {
+	p := &poller{
+		groups:     groups,
+		dispatcher: dispatcher,
+		stopped:    make(chan struct{}),
+	}
+
+	for _, group := range groups {
+		log.Printf("[INFO] startPoller - Polling %d device(s) in group %s every %s\n", len(group.devices), group.name, group.interval)
+		p.running.Add(1)
+		go p.run(group)
+	}
+	return p
+}
+
+// run polls the devices of a group immediately and then at the group interval,
+// until the poller is stopped
+func (p *poller) run(group *pollGroup) {
+	defer p.running.Done()
+
+	ticker := time.NewTicker(group.interval)
+	defer ticker.Stop()
+
+	for {
+		for _, device := range group.devices {
+			p.schedule(device)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-p.stopped:
+			return
+		}
+	}
+}
+
+// schedule queues a poll cycle for a device. The cycle is skipped if the previous
+// cycle of the device has not completed, so that a slow device does not build up
+// a backlog of polls.
+func (p *poller) schedule(device *pollDevice) {
+	if !atomic.CompareAndSwapInt32(&device.busy, 0, 1) {
+		log.Printf("[WARN] poller.schedule - Previous poll of %s in group %s has not completed, skipping\n", device.host, device.group)
+		return
+	}
+
+	if !p.dispatcher.enqueue(modbusHostKey(device.host), func() { pollDeviceTags(device) }) {
+		atomic.StoreInt32(&device.busy, 0)
+		log.Printf("[ERROR] poller.schedule - Request queue for modbus host %s is full, skipping poll of group %s\n", device.host, device.group)
+	}
+}
+
+// stop stops polling. Poll cycles that have already been queued are left to the
+// dispatcher.
+func (p *poller) stop() {
+	close(p.stopped)
+	p.running.Wait()
+}
+
+// pollDeviceTags reads the tags of a device and publishes their values
+func pollDeviceTags(device *pollDevice) {
+	defer atomic.StoreInt32(&device.busy, 0)
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			reportPanic(recovered, "pollDeviceTags", fmt.Sprintf("polling %s in group %s", device.host, device.group))
+		}
+	}()
+
+	log.Printf("[DEBUG] pollDeviceTags - Polling %d tag(s) of %s in group %s with %d read(s)\n", len(device.tags), device.host, device.group, len(device.blocks))
+	blockValues := make(map[*pollTag]tagValue, len(device.tags))
+	for _, block := range device.blocks {
+		for tag, value := range readTagBlock(device, block) {
+			blockValues[tag] = value
+		}
+	}
+
+	//Only the values that should be reported are published, in the order the tags were configured
+	captured := time.Now()
+	var reported []*pollTag
+	values := make([]tagValue, 0, len(device.tags))
+	for _, tag := range device.tags {
+		if tag.policy.shouldReport(tag.last, blockValues[tag], captured) {
+			reported = append(reported, tag)
+			values = append(values, blockValues[tag])
+		}
+	}
+	if len(values) == 0 {
+		log.Printf("[DEBUG] pollDeviceTags - No tag values of %s in group %s to report\n", device.host, device.group)
+		return
+	}
+
+	if err := publishPollData(device, values, captured); err != nil {
+		return
+	}
+	for ndx, tag := range reported {
+		tag.last = &tagReport{value: values[ndx], publishedAt: captured}
+	}
+}
+
+// readTagBlock reads a block through the modbus client and returns the values of
+// its tags. When the block cannot be read, or the value of a tag cannot be
+// decoded, the tag has bad quality and the error that was encountered.
+func readTagBlock(device *pollDevice, block *readBlock) map[*pollTag]tagValue {
+	values := make(map[*pollTag]tagValue, len(block.tags))
+
+	request := blockRequest(device, block)
+	response := newModbusResponse(request)
+	err := handleModbusRequest(request, response)
+	var blockError *responseError
+	if err != nil {
+		log.Printf("[ERROR] readTagBlock - Error reading %d address(es) from %d of %s: %s\n", block.addressCount, block.startAddress, device.host, err.Error())
+		blockError = &responseError{
+			Code:    requestFailureCode(request, err),
+			Message: err.Error(),
+		}
+	}
+
+	for _, tag := range block.tags {
+		value := tagValue{
+			Name:    tag.name,
+			Units:   tag.request.Units,
+			Quality: qualityGood,
+			Error:   blockError,
+		}
+		if blockError == nil {
+			data, err := tagData(block, response.Data, tag)
+			if err != nil {
+				log.Printf("[ERROR] readTagBlock - Error decoding tag %s: %s\n", tag.name, err.Error())
+				value.Error = &responseError{Code: 0, Message: err.Error()}
+			} else {
+				value.Value = singleValue(data)
+			}
+		}
+		if value.Error != nil {
+			value.Quality = qualityBad
+		}
+		values[tag] = value
+	}
+	return values
+}
+
+// singleValue returns the only value of the data read for a tag, or all of the
+// values if more than one was read
+func singleValue(data interface{}) interface{} {
+	values := reflect.ValueOf(data)
+	if values.Kind() == reflect.Slice && values.Len() == 1 {
+		return values.Index(0).Interface()
+	}
+	return data
+}
+
+// publishPollData publishes the tag values read from a device to the
+// {topicRoot}/data topic
+func publishPollData(device *pollDevice, values []tagValue, captured time.Time) error {
+	data := pollData{
+		Group:      device.group,
+		ModbusHost: device.host,
+		UnitID:     device.unitID,
+		Tags:       values,
+		Timestamp:  captured.Format(JavascriptISOString),
+		SiteID:     adapterID,
+	}
+
+	dataStr, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("[ERROR] publishPollData - ERROR marshalling json data: %s\n", err.Error())
+		return err
+	}
+
+	log.Printf("[DEBUG] publishPollData - Publishing %s to topic %s\n", string(dataStr), topicRoot+"/data")
+	if err = publish(topicRoot+"/data", string(dataStr)); err != nil {
+		log.Printf("[ERROR] publishPollData - ERROR publishing to topic: %s\n", err.Error())
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadPollConfig(t *testing.T) {
+	defer func(groups []*pollGroup) { pollGroups = groups }(pollGroups)
+
+	config := `{"Groups":[{"Name":"fast","Interval":0.5,"Deadband":2,"MaxSilence":60,"Devices":[{
+		"ModbusHost":"192.168.0.9:502","UnitID":7,"ByteOrder":"CDAB","FunctionCode":3,
+		"Tags":[
+			{"Name":"Pressure","StartAddress":100,"DataType":"float32","Deadband":0.5},
+			{"Name":"Level","FunctionCode":4,"StartAddress":10,"AddressCount":1,"ByteOrder":"ABCD"},
+			{"Name":"PumpRunning","FunctionCode":1,"StartAddress":0,"AddressCount":1}
+		]}]}]}`
+	if err := loadPollConfig(config); err != nil {
+		t.Fatalf("loadPollConfig returned error: %s", err)
+	}
+
+	if len(pollGroups) != 1 || pollGroups[0].name != "fast" || pollGroups[0].interval != 500*time.Millisecond {
+		t.Fatalf("pollGroups = %+v", pollGroups)
+	}
+	if len(pollGroups[0].devices) != 1 {
+		t.Fatalf("%d device(s) loaded, want 1", len(pollGroups[0].devices))
+	}
+	device := pollGroups[0].devices[0]
+	if device.group != "fast" || device.host != "192.168.0.9:502" || device.unitID == nil || *device.unitID != 7 {
+		t.Errorf("device = %+v", device)
+	}
+	if len(device.tags) != 3 || len(device.blocks) != 3 {
+		t.Fatalf("%d tag(s) in %d block(s) loaded, want 3 in 3", len(device.tags), len(device.blocks))
+	}
+
+	//Tags inherit the fields of their device unless they specify them
+	tests := []struct {
+		tag          *pollTag
+		name         string
+		functionCode uint8
+		addressCount uint16
+		byteOrder    string
+		policy       reportPolicy
+	}{
+		{device.tags[0], "Pressure", 3, 2, "CDAB", reportPolicy{deadband: 0.5, maxSilence: time.Minute}},
+		{device.tags[1], "Level", 4, 1, "ABCD", reportPolicy{deadband: 2, maxSilence: time.Minute}},
+		{device.tags[2], "PumpRunning", 1, 1, "CDAB", reportPolicy{deadband: 2, maxSilence: time.Minute}},
+	}
+	for _, test := range tests {
+		request := test.tag.request
+		if test.tag.name != test.name || request.ModbusHost != device.host || request.UnitID == nil || *request.UnitID != 7 {
+			t.Errorf("%s: tag = %+v, request = %+v", test.name, test.tag, request)
+			continue
+		}
+		if *request.FunctionCode != test.functionCode || *request.AddressCount != test.addressCount || request.ByteOrder != test.byteOrder {
+			t.Errorf("%s: FunctionCode = %d, AddressCount = %d, ByteOrder = %s, want %d, %d, %s", test.name,
+				*request.FunctionCode, *request.AddressCount, request.ByteOrder, test.functionCode, test.addressCount, test.byteOrder)
+		}
+		if test.tag.policy != test.policy {
+			t.Errorf("%s: policy = %+v, want %+v", test.name, test.tag.policy, test.policy)
+		}
+	}
+}
+
+func TestLoadPollConfigErrors(t *testing.T) {
+	defer func(groups []*pollGroup) { pollGroups = groups }(pollGroups)
+
+	//A group containing a single device, with its fields and tags
+	group := func(device string, tags string) string {
+		return `{"Groups":[{"Name":"fast","Interval":1,"Devices":[{` + device + `"Tags":[` + tags + `]}]}]}`
+	}
+	const host = `"ModbusHost":"192.168.0.9:502",`
+	const tag = `{"Name":"Level","FunctionCode":3,"StartAddress":0,"AddressCount":1}`
+
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"unknown field", `{"Groupz":[]}`, `poll_config is invalid: Unknown field "Groupz"`},
+		{"group without name", `{"Groups":[{"Interval":1}]}`, "Every poll group must have a Name"},
+		{"duplicate group", `{"Groups":[{"Name":"fast","Interval":1},{"Name":"fast","Interval":2}]}`, "Poll group fast is specified more than once"},
+		{"missing interval", `{"Groups":[{"Name":"fast"}]}`, "Interval of poll group fast must be a number of seconds greater than 0"},
+		{"negative interval", `{"Groups":[{"Name":"fast","Interval":-1}]}`, "Interval of poll group fast must be a number of seconds greater than 0"},
+		{"interval not a number", `{"Groups":[{"Name":"fast","Interval":"5s"}]}`, "poll_config is invalid:"},
+		{"invalid group deadband", `{"Groups":[{"Name":"fast","Interval":1,"Deadband":-1}]}`, "Poll group fast: Deadband must not be negative"},
+		{"missing ModbusHost", group(``, tag), "Poll group fast: Every device must have a ModbusHost"},
+		{"invalid ModbusHost", group(`"ModbusHost":"udp://192.168.0.9:502",`, tag), "Poll group fast: Unsupported modbus transport: udp"},
+		{"ModbusHost not a string", group(`"ModbusHost":502,`, tag), "Poll group fast:"},
+		{"UnitID out of range", group(host+`"UnitID":256,`, tag), "Poll group fast:"},
+		{"UnitID not a number", group(host+`"UnitID":"1",`, tag), "Poll group fast:"},
+		{"no tags", group(host, ``), "Poll group fast: Tags of device 192.168.0.9:502 must be a non-empty array of objects"},
+		{"tag without name", group(host, `{"FunctionCode":3,"StartAddress":0,"AddressCount":1}`), "Device 192.168.0.9:502: Every tag must have a Name"},
+		{"duplicate tag", group(host, tag+`,`+tag), "Poll group fast: Device 192.168.0.9:502: Tag Level is specified more than once"},
+		{"tag with ModbusHost", group(host, `{"Name":"Level","ModbusHost":"192.168.0.10:502","FunctionCode":3,"StartAddress":0,"AddressCount":1}`), "Tag Level must not specify ModbusHost or UnitID, they are specified by the device"},
+		{"tag with UnitID", group(host, `{"Name":"Level","UnitID":2,"FunctionCode":3,"StartAddress":0,"AddressCount":1}`), "Tag Level must not specify ModbusHost or UnitID, they are specified by the device"},
+		{"write function code", group(host, `{"Name":"Level","FunctionCode":6,"StartAddress":0,"Data":[1]}`), "Tag Level: FunctionCode must be 1, 2, 3 or 4"},
+		{"read write function code", group(host, `{"Name":"Level","FunctionCode":23,"StartAddress":0,"AddressCount":1,"WriteStartAddress":0,"Data":[1]}`), "Tag Level: FunctionCode must be 1, 2, 3 or 4"},
+		{"diagnostics function code", group(host, `{"Name":"Level","FunctionCode":8,"SubFunction":0,"Data":[1]}`), "Tag Level: FunctionCode must be 1, 2, 3 or 4"},
+		{"invalid read", group(host, `{"Name":"Level","FunctionCode":3,"StartAddress":0}`), "Tag Level: AddressCount is required"},
+		{"unknown tag field", group(host, `{"Name":"Level","FunctionCode":3,"StartAddress":0,"AddressCount":1,"Adress":1}`), `Tag Level: Unknown field "Adress"`},
+		{"invalid tag deadband", group(host, `{"Name":"Level","FunctionCode":3,"StartAddress":0,"AddressCount":1,"MaxSilence":-1}`), "Tag Level: MaxSilence must not be negative"},
+	}
+
+	for _, test := range tests {
+		pollGroups = nil
+		err := loadPollConfig(test.config)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: loadPollConfig error = %v, want %q", test.name, err, test.err)
+		}
+		if pollGroups != nil {
+			t.Errorf("%s: loadPollConfig loaded the poll groups of an invalid config", test.name)
+		}
+	}
+}
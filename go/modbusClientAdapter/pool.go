@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	modbus "github.com/goburrow/modbus"
+)
+
+// modbusConnection is a live connection to a single modbus host
+type modbusConnection struct {
+	host     string
+	target   *modbusTarget
+	handler  modbusClientHandler
+	client   modbus.Client
+	lastUsed time.Time
+}
+
+// modbusConnectionPool keeps one persistent connection per ModbusHost so that
+// requests interleaved across many hosts reuse their connections. Connections
+// are keyed by the key of their modbusTarget, so that equivalent ModbusHost
+// values share a connection and a serial port is only opened once. The mutex only
+// guards the map of connections. Connecting and closing are done without holding
+// it, so that a host that is slow to connect does not delay requests for other
+// hosts. Each host is only used by its own dispatcher worker, which serializes
+// access to its connection.
+type modbusConnectionPool struct {
+	mu          sync.Mutex
+	connections map[string]*modbusConnection
+	idleTimeout time.Duration
+}
+
+func newModbusConnectionPool(idleTimeout time.Duration) *modbusConnectionPool {
+	return &modbusConnectionPool{
+		connections: make(map[string]*modbusConnection),
+		idleTimeout: idleTimeout,
+	}
+}
+
+// get returns the connection for the specified host, connecting to the host if
+// there is no live connection in the pool. A serial port that is already open
+// with different line settings cannot be used.
+func (pool *modbusConnectionPool) get(host string) (*modbusConnection, error) {
+	target, err := parseModbusHost(host)
+	if err != nil {
+		log.Printf("[DEBUG] modbusConnectionPool.get - Invalid address for modbus host: %s\n", host)
+		return nil, err
+	}
+	key := target.key()
+
+	pool.mu.Lock()
+	if conn, ok := pool.connections[key]; ok {
+		conn.lastUsed = time.Now()
+		pool.mu.Unlock()
+		return conn, conn.conflict(target)
+	}
+	pool.mu.Unlock()
+
+	//Connecting to an unreachable host can take up to the connect timeout
+	log.Printf("[DEBUG] modbusConnectionPool.get - No connection for %s in pool. Connecting\n", host)
+	conn, err := newModbusConnection(host, target)
+	if err != nil {
+		return nil, err
+	}
+
+	pool.mu.Lock()
+	existing, ok := pool.connections[key]
+	if ok {
+		existing.lastUsed = time.Now()
+	} else {
+		pool.connections[key] = conn
+	}
+	count := len(pool.connections)
+	pool.mu.Unlock()
+
+	if ok {
+		//The host was connected to by another request while this one was connecting
+		conn.handler.Close()
+		return existing, existing.conflict(target)
+	}
+
+	log.Printf("[DEBUG] modbusConnectionPool.get - %d connection(s) in pool\n", count)
+	return conn, nil
+}
+
+// remove closes the connection to the specified host and removes it from the pool
+func (pool *modbusConnectionPool) remove(host string) {
+	key := modbusHostKey(host)
+
+	pool.mu.Lock()
+	conn, ok := pool.connections[key]
+	delete(pool.connections, key)
+	pool.mu.Unlock()
+
+	if ok {
+		log.Printf("[DEBUG] modbusConnectionPool.remove - Closing connection to %s\n", host)
+		conn.handler.Close()
+	}
+}
+
+// evictIdle closes and removes every connection that has not been used within the
+// idle timeout of the pool
+func (pool *modbusConnectionPool) evictIdle() {
+	pool.mu.Lock()
+	var idle []*modbusConnection
+	for host, conn := range pool.connections {
+		if time.Since(conn.lastUsed) >= pool.idleTimeout {
+			idle = append(idle, conn)
+			delete(pool.connections, host)
+		}
+	}
+	pool.mu.Unlock()
+
+	for _, conn := range idle {
+		log.Printf("[DEBUG] modbusConnectionPool.evictIdle - Evicting idle connection to %s\n", conn.host)
+		conn.handler.Close()
+	}
+}
+
+// closeAll closes every connection in the pool
+func (pool *modbusConnectionPool) closeAll() {
+	pool.mu.Lock()
+	connections := pool.connections
+	pool.connections = make(map[string]*modbusConnection)
+	pool.mu.Unlock()
+
+	for _, conn := range connections {
+		conn.handler.Close()
+	}
+}
+
+// conflict returns an error if the connection cannot be used for the target
+// because it is a serial port that was opened with different line settings
+func (conn *modbusConnection) conflict(target *modbusTarget) error {
+	if conn.target.sameLine(target) {
+		return nil
+	}
+	return &portConflictError{address: target.address, host: conn.host}
+}
+
+// portConflictError is returned for a serial port that is already open with
+// different line settings. The connection that has the port open is kept.
+type portConflictError struct {
+	address string
+	host    string
+}
+
+func (err *portConflictError) Error() string {
+	return fmt.Sprintf("Serial port %s is already in use by %s, with different settings", err.address, err.host)
+}
+
+func newModbusConnection(address string, target *modbusTarget) (*modbusConnection, error) {
+	log.Printf("[DEBUG] newModbusConnection - Creating %s modbus handler for %s\n", target.transport, target.address)
+	handler := newModbusHandler(target)
+
+	// Connect to modbus manually so that multiple requests are handled in one connection session
+	log.Println("[DEBUG] newModbusConnection - Connecting modbus handler")
+	if err := handler.Connect(); err != nil {
+		return nil, err
+	}
+
+	return &modbusConnection{
+		host:     address,
+		target:   target,
+		handler:  handler,
+		client:   modbus.NewClient(handler),
+		lastUsed: time.Now(),
+	}, nil
+}
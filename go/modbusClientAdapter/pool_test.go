@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestModbusHostKey(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"192.168.0.9:502", "192.168.0.9:502"},
+		{"tcp://192.168.0.9:502", "192.168.0.9:502"},
+		{"rtuovertcp://192.168.0.9:502", "rtuovertcp://192.168.0.9:502"},
+		{"rtu:///dev/ttyUSB0", "serial:///dev/ttyUSB0"},
+		{"rtu:///dev/ttyUSB0?baud=9600&parity=N&stop=2", "serial:///dev/ttyUSB0"},
+		{"ascii:///dev/ttyUSB0?baud=9600", "serial:///dev/ttyUSB0"},
+		{"rtu:///dev/ttyUSB1", "serial:///dev/ttyUSB1"},
+		{"udp://192.168.0.9:502", "udp://192.168.0.9:502"},
+	}
+
+	for _, test := range tests {
+		if got := modbusHostKey(test.host); got != test.want {
+			t.Errorf("modbusHostKey(%q) = %q, want %q", test.host, got, test.want)
+		}
+	}
+}
+
+func TestPoolSharesConnectionsByTarget(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			if _, err := listener.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	pool := newModbusConnectionPool(time.Minute)
+	defer pool.closeAll()
+
+	address := listener.Addr().String()
+	first, err := pool.get(address)
+	if err != nil {
+		t.Fatalf("get(%q) returned error: %s", address, err)
+	}
+	second, err := pool.get("tcp://" + address)
+	if err != nil {
+		t.Fatalf("get(%q) returned error: %s", "tcp://"+address, err)
+	}
+	if first != second {
+		t.Error("equivalent modbus hosts did not share a connection")
+	}
+
+	pool.remove("tcp://" + address)
+	if len(pool.connections) != 0 {
+		t.Errorf("remove left %d connection(s) in the pool", len(pool.connections))
+	}
+}
+
+func TestPoolRejectsConflictingSerialSettings(t *testing.T) {
+	target, err := parseModbusHost("rtu:///dev/ttyUSB0?baud=9600")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := newModbusConnectionPool(time.Minute)
+	//A serial port that is already open, without opening a real device
+	pool.connections[target.key()] = &modbusConnection{
+		host:     "rtu:///dev/ttyUSB0?baud=9600",
+		target:   target,
+		handler:  newRTUClientHandler(target.address),
+		lastUsed: time.Now(),
+	}
+
+	tests := []struct {
+		host     string
+		conflict bool
+	}{
+		{"rtu:///dev/ttyUSB0?baud=9600", false},
+		{"rtu:///dev/ttyUSB0?baud=9600&parity=E&timeout=1s", false},
+		{"rtu:///dev/ttyUSB0?baud=19200", true},
+		{"rtu:///dev/ttyUSB0?baud=9600&parity=N&stop=2", true},
+		{"ascii:///dev/ttyUSB0?baud=9600&data=8", true},
+	}
+
+	for _, test := range tests {
+		conn, err := pool.get(test.host)
+		if test.conflict && err == nil {
+			t.Errorf("get(%q) did not return an error", test.host)
+		}
+		if !test.conflict && (err != nil || conn.target != target) {
+			t.Errorf("get(%q) = %v, %v, want the open serial port", test.host, conn, err)
+		}
+	}
+}
+
+func TestPoolEvictsIdleConnections(t *testing.T) {
+	pool := newModbusConnectionPool(time.Minute)
+	idle := &closeRecorder{}
+	recent := &closeRecorder{}
+	pool.connections["192.168.0.9:502"] = &modbusConnection{host: "192.168.0.9:502", handler: idle, lastUsed: time.Now().Add(-2 * time.Minute)}
+	pool.connections["192.168.0.10:502"] = &modbusConnection{host: "192.168.0.10:502", handler: recent, lastUsed: time.Now()}
+
+	pool.evictIdle()
+
+	if _, ok := pool.connections["192.168.0.9:502"]; ok || !idle.closed {
+		t.Errorf("idle connection was not evicted: in pool = %t, closed = %t", ok, idle.closed)
+	}
+	if _, ok := pool.connections["192.168.0.10:502"]; !ok || recent.closed {
+		t.Errorf("recently used connection was evicted: in pool = %t, closed = %t", ok, recent.closed)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// deviceProfiles contains the request defaults for each configured modbus host,
+// keyed by ModbusHost. Profiles are loaded from the device_profiles column of the
+// adapter configuration collection at startup.
+var deviceProfiles = map[string]map[string]interface{}{}
+
+// deviceProfileFields are the request fields that a device profile may provide
+var deviceProfileFields = []string{"ByteOrder"}
+
+// loadDeviceProfiles parses the device_profiles adapter configuration, which is a
+// json object (or a string containing one) keyed by ModbusHost, e.g.
+//
+//	{"192.168.0.9:502": {"ByteOrder": "CDAB"}}
+func loadDeviceProfiles(config interface{}) error {
+	if configStr, ok := config.(string); ok {
+		var parsed interface{}
+		if err := json.Unmarshal([]byte(configStr), &parsed); err != nil {
+			return fmt.Errorf("device_profiles is not valid json: %s", err.Error())
+		}
+		config = parsed
+	}
+
+	hosts, ok := config.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("device_profiles must be a json object keyed by ModbusHost")
+	}
+
+	profiles := make(map[string]map[string]interface{}, len(hosts))
+	for host, value := range hosts {
+		profile, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("device profile for %s must be a json object", host)
+		}
+		profiles[host] = profile
+	}
+
+	deviceProfiles = profiles
+	log.Printf("[DEBUG] loadDeviceProfiles - %d device profile(s) loaded\n", len(deviceProfiles))
+	return nil
+}
+
+// deviceProfile returns the fields of the device profile for a ModbusHost as a
+// json request, or nil if the host does not have a profile
+func deviceProfile(host string) []byte {
+	profile, ok := deviceProfiles[host]
+	if !ok {
+		return nil
+	}
+
+	fields := make(map[string]interface{})
+	for _, field := range deviceProfileFields {
+		if profile[field] != nil {
+			fields[field] = profile[field]
+		}
+	}
+
+	profileJSON, err := json.Marshal(fields)
+	if err != nil {
+		log.Printf("[ERROR] deviceProfile - Device profile for %s could not be marshalled: %s\n", host, err.Error())
+		return nil
+	}
+	return profileJSON
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestLoadDeviceProfiles(t *testing.T) {
+	defer func(profiles map[string]map[string]interface{}) { deviceProfiles = profiles }(deviceProfiles)
+
+	if err := loadDeviceProfiles(`{"192.168.0.9:502": {"ByteOrder": "CDAB", "Comment": "meter"}}`); err != nil {
+		t.Fatalf("loadDeviceProfiles returned error: %s", err)
+	}
+	if profile := string(deviceProfile("192.168.0.9:502")); profile != `{"ByteOrder":"CDAB"}` {
+		t.Errorf("deviceProfile = %s, want only the profile fields", profile)
+	}
+	if profile := deviceProfile("192.168.0.10:502"); profile != nil {
+		t.Errorf("deviceProfile of a host without a profile = %s", profile)
+	}
+
+	if err := loadDeviceProfiles(map[string]interface{}{"rtu:///dev/ttyUSB0": map[string]interface{}{"ByteOrder": "DCBA"}}); err != nil {
+		t.Fatalf("loadDeviceProfiles returned error: %s", err)
+	}
+	if profile := string(deviceProfile("rtu:///dev/ttyUSB0")); profile != `{"ByteOrder":"DCBA"}` {
+		t.Errorf("deviceProfile = %s", profile)
+	}
+
+	for _, config := range []interface{}{`{"192.168.0.9:502": `, `[]`, []interface{}{}, map[string]interface{}{"192.168.0.9:502": "CDAB"}} {
+		if err := loadDeviceProfiles(config); err == nil {
+			t.Errorf("loadDeviceProfiles(%#v) did not return an error", config)
+		}
+	}
+	//Invalid profiles do not replace the profiles already loaded
+	if profile := string(deviceProfile("rtu:///dev/ttyUSB0")); profile != `{"ByteOrder":"DCBA"}` {
+		t.Errorf("deviceProfile after invalid profiles = %s", profile)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	modbus "github.com/goburrow/modbus"
+)
+
+const (
+	rawEncodingHex    = "hex"
+	rawEncodingBase64 = "base64"
+
+	//The function code is the first byte of the 253 byte PDU
+	rawPDUMaxSize = 252
+)
+
+// rawEncoding returns the encoding of the RawPDU in a request, defaulting to hex
+func rawEncoding(value string) (string, error) {
+	if value == "" {
+		return rawEncodingHex, nil
+	}
+	encoding := strings.ToLower(value)
+	if encoding == rawEncodingHex || encoding == rawEncodingBase64 {
+		return encoding, nil
+	}
+	return "", fmt.Errorf("RawEncoding must be either '%s' or '%s'", rawEncodingHex, rawEncodingBase64)
+}
+
+// decodeRawPDU decodes the data portion of a raw PDU, which excludes the function code
+func decodeRawPDU(body string, encoding string) ([]byte, error) {
+	var data []byte
+	var err error
+	if encoding == rawEncodingBase64 {
+		data, err = base64.StdEncoding.DecodeString(body)
+	} else {
+		data, err = hex.DecodeString(strings.Replace(body, " ", "", -1))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("RawPDU is not valid %s: %s", encoding, err.Error())
+	}
+	if len(data) > rawPDUMaxSize {
+		return nil, fmt.Errorf("RawPDU must not be longer than %d bytes", rawPDUMaxSize)
+	}
+	return data, nil
+}
+
+// encodeRawPDU encodes the data portion of a raw response PDU
+func encodeRawPDU(data []byte, encoding string) string {
+	if encoding == rawEncodingBase64 {
+		return base64.StdEncoding.EncodeToString(data)
+	}
+	return hex.EncodeToString(data)
+}
+
+// sendRawPDU sends a request with an arbitrary function code and data and returns
+// the data of the response PDU. The response is not interpreted beyond checking
+// for a modbus exception.
+func sendRawPDU(handler modbusClientHandler, functionCode byte, data []byte) ([]byte, error) {
+	response, err := exchangePDU(handler, &modbus.ProtocolDataUnit{FunctionCode: functionCode, Data: data})
+	if err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDecodeRawPDU(t *testing.T) {
+	tests := []struct {
+		body     string
+		encoding string
+		want     []byte
+		err      string
+	}{
+		{body: "", encoding: rawEncodingHex, want: []byte{}},
+		{body: "0102a0", encoding: rawEncodingHex, want: []byte{0x01, 0x02, 0xA0}},
+		{body: "01 02 A0", encoding: rawEncodingHex, want: []byte{0x01, 0x02, 0xA0}},
+		{body: "AQKg", encoding: rawEncodingBase64, want: []byte{0x01, 0x02, 0xA0}},
+		{body: "", encoding: rawEncodingBase64, want: []byte{}},
+		{body: "010", encoding: rawEncodingHex, err: "RawPDU is not valid hex"},
+		{body: "zz", encoding: rawEncodingHex, err: "RawPDU is not valid hex"},
+		{body: "AQK", encoding: rawEncodingBase64, err: "RawPDU is not valid base64"},
+		{body: strings.Repeat("00", rawPDUMaxSize), encoding: rawEncodingHex, want: make([]byte, rawPDUMaxSize)},
+		{body: strings.Repeat("00", rawPDUMaxSize+1), encoding: rawEncodingHex, err: "RawPDU must not be longer than 252 bytes"},
+	}
+
+	for _, test := range tests {
+		data, err := decodeRawPDU(test.body, test.encoding)
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("decodeRawPDU(%q, %s) error = %v, want %q", test.body, test.encoding, err, test.err)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(data, test.want) {
+			t.Errorf("decodeRawPDU(%q, %s) = % x, %v, want % x", test.body, test.encoding, data, err, test.want)
+		}
+	}
+}
+
+func TestValidateRawRequest(t *testing.T) {
+	tests := []struct {
+		payload string
+		err     string
+	}{
+		{payload: `{"ModbusHost":"192.168.0.9:502","FunctionCode":65,"RawPDU":""}`},
+		{payload: `{"ModbusHost":"192.168.0.9:502","FunctionCode":65,"RawPDU":"0102a0"}`},
+		{payload: `{"ModbusHost":"192.168.0.9:502","FunctionCode":3,"RawPDU":"00000001"}`},
+		{payload: `{"ModbusHost":"192.168.0.9:502","FunctionCode":65,"RawPDU":"AQKg","RawEncoding":"BASE64"}`},
+		{payload: `{"ModbusHost":"192.168.0.9:502","FunctionCode":65}`, err: "Invalid FunctionCode"},
+		{payload: `{"ModbusHost":"192.168.0.9:502","FunctionCode":0,"RawPDU":""}`, err: "FunctionCode must be an integer between 1 and 127 for raw requests"},
+		{payload: `{"ModbusHost":"192.168.0.9:502","FunctionCode":128,"RawPDU":""}`, err: "FunctionCode must be an integer between 1 and 127 for raw requests"},
+		{payload: `{"ModbusHost":"192.168.0.9:502","FunctionCode":65,"RawPDU":"zz"}`, err: "RawPDU is not valid hex"},
+		{payload: `{"ModbusHost":"192.168.0.9:502","FunctionCode":65,"RawPDU":"","RawEncoding":"utf8"}`, err: "RawEncoding must be either 'hex' or 'base64'"},
+	}
+
+	for _, test := range tests {
+		request, err := decodeRequest([]byte(test.payload))
+		if err != nil {
+			t.Errorf("decodeRequest(%s) returned error: %s", test.payload, err)
+			continue
+		}
+		err = validateRequest(request)
+		if test.err == "" && err != nil {
+			t.Errorf("validateRequest(%s) returned error: %s", test.payload, err)
+		}
+		if test.err != "" && (err == nil || !strings.HasPrefix(err.Error(), test.err)) {
+			t.Errorf("validateRequest(%s) error = %v, want %q", test.payload, err, test.err)
+		}
+	}
+}
+
+func TestRawRequestOverSerialRTU(t *testing.T) {
+	var requests [][]byte
+	handler := newRTULoopback(t, func(request []byte) [][]byte {
+		requests = append(requests, append([]byte(nil), request...))
+		return [][]byte{rtuFrame(t, 65, []byte{0xAB, 0xCD})}
+	})
+
+	request, err := decodeRequest([]byte(`{"ModbusHost":"rtu:///dev/ttyUSB0","FunctionCode":65,"RawPDU":""}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := newModbusResponse(request)
+	if err := handleRawRequest(handler, request, response); err != nil {
+		t.Fatalf("handleRawRequest returned error: %s", err)
+	}
+	if response.RawResponse != "abcd" || response.RawEncoding != rawEncodingHex {
+		t.Errorf("handleRawRequest response = %q (%s)", response.RawResponse, response.RawEncoding)
+	}
+	//Slave id, function code and crc
+	if len(requests) != 1 || len(requests[0]) != 4 || requests[0][1] != 65 {
+		t.Errorf("request = % x, want an empty PDU", requests)
+	}
+
+	//The empty RawPDU is echoed in the response
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(responseJSON, []byte(`"RawPDU":""`)) {
+		t.Errorf("response %s does not echo RawPDU", responseJSON)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+)
+
+// errorCodeInternal is reported when the adapter fails while processing a request
+const errorCodeInternal = 103
+
+// requestPanics is the number of requests and poll cycles whose processing has
+// panicked
+var requestPanics uint64
+
+// handleRequestSafely processes a request with the handler, recovering from any
+// panic so that a malformed request cannot stop the worker processing it. The
+// panic is reported to the client in an error response.
+func handleRequestSafely(handler func([]byte), payload []byte) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			fingerprint := reportPanic(recovered, "handleRequestSafely", "processing request")
+			log.Printf("[DEBUG] handleRequestSafely - Request: %s\n", string(payload))
+			publishPanicResponse(payload, recovered, fingerprint)
+		}
+	}()
+
+	handler(payload)
+}
+
+// reportPanic counts and logs a panic recovered in the boundary function, the
+// function that recovers it, and returns the fingerprint of the panic. It must be
+// called from the deferred recovery function of the boundary function. The stack
+// trace is only logged at the debug log level.
+func reportPanic(recovered interface{}, boundary string, context string) string {
+	count := atomic.AddUint64(&requestPanics, 1)
+	fingerprint := stackFingerprint(boundary)
+	log.Printf("[ERROR] %s - Recovered from panic %d %s: %v (fingerprint %s)\n", boundary, count, context, recovered, fingerprint)
+	log.Printf("[DEBUG] %s - %s\n", boundary, debug.Stack())
+	return fingerprint
+}
+
+// publishPanicResponse publishes an error response for a request whose processing
+// panicked. The fingerprint identifies the code that panicked, so that reports of
+// the same failure can be grouped without exposing the stack trace to clients. It
+// is only included in the response at the debug log level.
+func publishPanicResponse(payload []byte, recovered interface{}, fingerprint string) {
+	//The request is echoed on a best effort basis, it may be what caused the panic
+	request := &modbusRequest{}
+	json.Unmarshal(payload, request)
+
+	response := newModbusResponse(request)
+	addErrorToResponse(response, fmt.Sprintf("Internal error processing request: %v", recovered), errorCodeInternal)
+	if strings.EqualFold(logLevel, "debug") {
+		response.Error.Fingerprint = fingerprint
+	}
+	response.Request = payload
+	publishModbusResponse(response)
+}
+
+// stackFingerprint returns a short hash of the functions and lines on the stack of
+// the panicking goroutine, from where it panicked up to the boundary function. It
+// must be called by reportPanic. The runtime frames of the panic itself are
+// excluded, as are addresses and goroutine ids, so the same failure always has
+// the same fingerprint.
+func stackFingerprint(boundary string) string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(4, pcs)])
+
+	hash := sha1.New()
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "runtime.") {
+			fmt.Fprintf(hash, "%s %s:%d\n", frame.Function, filepath.Base(frame.File), frame.Line)
+		}
+		if !more || strings.HasSuffix(frame.Function, "."+boundary) {
+			break
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:12]
+}
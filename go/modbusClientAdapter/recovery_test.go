@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+// recoverFingerprint runs fn, returning the fingerprint of its panic
+func recoverFingerprint(fn func()) (fingerprint string) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			fingerprint = reportPanic(recovered, "recoverFingerprint", "testing")
+		}
+	}()
+
+	fn()
+	return ""
+}
+
+func panicNilMap() {
+	var values map[string]int
+	values["x"] = 1
+}
+
+func panicIndex() {
+	var values []int
+	_ = values[len(values)+1]
+}
+
+func recoverFromCaller() string {
+	return recoverFingerprint(panicNilMap)
+}
+
+func TestReportPanic(t *testing.T) {
+	before := atomic.LoadUint64(&requestPanics)
+
+	nilMap := recoverFingerprint(panicNilMap)
+	if len(nilMap) != 12 {
+		t.Fatalf("fingerprint = %q, want 12 hex digits", nilMap)
+	}
+	if again := recoverFingerprint(panicNilMap); again != nilMap {
+		t.Errorf("fingerprint of the same panic = %s, want %s", again, nilMap)
+	}
+	//Frames above the boundary function do not change the fingerprint
+	if caller := recoverFromCaller(); caller != nilMap {
+		t.Errorf("fingerprint of the same panic from another caller = %s, want %s", caller, nilMap)
+	}
+	if index := recoverFingerprint(panicIndex); index == nilMap {
+		t.Errorf("fingerprint of a different panic = %s, want a different fingerprint", index)
+	}
+
+	if count := atomic.LoadUint64(&requestPanics) - before; count != 4 {
+		t.Errorf("requestPanics increased by %d, want 4", count)
+	}
+}
+
+func TestPollDeviceTagsRecovers(t *testing.T) {
+	before := atomic.LoadUint64(&requestPanics)
+
+	//A nil read block panics
+	device := &pollDevice{group: "fast", host: "192.168.0.9:502", blocks: []*readBlock{nil}, busy: 1}
+	pollDeviceTags(device)
+
+	if count := atomic.LoadUint64(&requestPanics) - before; count != 1 {
+		t.Errorf("requestPanics increased by %d, want 1", count)
+	}
+	if device.busy != 0 {
+		t.Error("device is still busy after a panic")
+	}
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	dataTypeUint16   = "uint16"
+	dataTypeInt16    = "int16"
+	dataTypeUint32   = "uint32"
+	dataTypeInt32    = "int32"
+	dataTypeFloat32  = "float32"
+	dataTypeUint64   = "uint64"
+	dataTypeInt64    = "int64"
+	dataTypeFloat64  = "float64"
+	dataTypeBCD16    = "bcd16"
+	dataTypeBCD32    = "bcd32"
+	dataTypeBitfield = "bitfield"
+	//Strings are specified with their length in registers, e.g. string:10
+	dataTypeString = "string"
+
+	//The most values that can be requested for a single DataType
+	maxValueCount = 125
+)
+
+// Byte orders of multi-register values, named by the position of the bytes of
+// the big endian value 0xAABBCCDD in the registers read from the device
+const (
+	byteOrderABCD = "ABCD" //Big endian
+	byteOrderCDAB = "CDAB" //Big endian bytes, registers swapped
+	byteOrderBADC = "BADC" //Bytes swapped within each register
+	byteOrderDCBA = "DCBA" //Little endian
+)
+
+// dataTypeRegisters is the number of 16 bit registers used by each data type
+var dataTypeRegisters = map[string]int{
+	dataTypeUint16:   1,
+	dataTypeInt16:    1,
+	dataTypeUint32:   2,
+	dataTypeInt32:    2,
+	dataTypeFloat32:  2,
+	dataTypeUint64:   4,
+	dataTypeInt64:    4,
+	dataTypeFloat64:  4,
+	dataTypeBCD16:    1,
+	dataTypeBCD32:    2,
+	dataTypeBitfield: 1,
+}
+
+// registerFormat contains the request options that control how register values
+// are decoded
+type registerFormat struct {
+	byteOrder   string
+	bitNames    []string
+	trimStrings bool
+}
+
+// requestRegisterFormat returns the register format options of a request
+func requestRegisterFormat(request *modbusRequest) registerFormat {
+	format := registerFormat{byteOrder: byteOrderABCD, trimStrings: true}
+
+	if request.ByteOrder != "" {
+		format.byteOrder = request.ByteOrder
+	}
+	if request.TrimStrings != nil {
+		format.trimStrings = *request.TrimStrings
+	}
+	if request.BitNames != nil {
+		format.bitNames = make([]string, len(request.BitNames))
+		for ndx, name := range request.BitNames {
+			if name != nil {
+				format.bitNames[ndx] = *name
+			}
+		}
+	}
+	return format
+}
+
+// validateRegisterFormat validates the register format options of a request
+func validateRegisterFormat(request *modbusRequest) error {
+	if len(request.BitNames) > 16 {
+		return fmt.Errorf("BitNames must be an array of at most 16 names")
+	}
+	return nil
+}
+
+// dataTypeSize returns the number of registers used by a data type, and false if
+// the data type is not supported
+func dataTypeSize(dataType string) (int, bool) {
+	if strings.HasPrefix(dataType, dataTypeString+":") {
+		length, err := strconv.Atoi(strings.TrimPrefix(dataType, dataTypeString+":"))
+		if err != nil || length < 1 || length > maxValueCount {
+			return 0, false
+		}
+		return length, true
+	}
+	size, ok := dataTypeRegisters[dataType]
+	return size, ok
+}
+
+// requestDataTypes returns the data type of each value in a typed register
+// request. DataTypes lists the type of each value in order, while DataType
+// applies a single type to ValueCount (default 1) consecutive values.
+func requestDataTypes(request *modbusRequest) ([]string, error) {
+	if request.DataTypes != nil {
+		if len(request.DataTypes) == 0 {
+			return nil, fmt.Errorf("DataTypes must be an array of data types")
+		}
+		for _, dataType := range request.DataTypes {
+			if _, valid := dataTypeSize(dataType); !valid {
+				return nil, fmt.Errorf("Invalid data type %v in DataTypes", dataType)
+			}
+		}
+		return request.DataTypes, nil
+	}
+
+	if _, valid := dataTypeSize(request.DataType); !valid {
+		return nil, fmt.Errorf("Invalid DataType %v", request.DataType)
+	}
+
+	valueCount := 1
+	if request.ValueCount != nil {
+		if *request.ValueCount < 1 || *request.ValueCount > maxValueCount {
+			return nil, fmt.Errorf("ValueCount must be an integer between 1 and %d", maxValueCount)
+		}
+		valueCount = int(*request.ValueCount)
+	}
+
+	dataTypes := make([]string, valueCount)
+	for ndx := range dataTypes {
+		dataTypes[ndx] = request.DataType
+	}
+	return dataTypes, nil
+}
+
+// registerCount returns the number of registers needed to hold the data types
+func registerCount(dataTypes []string) int {
+	count := 0
+	for _, dataType := range dataTypes {
+		size, _ := dataTypeSize(dataType)
+		count += size
+	}
+	return count
+}
+
+// isByteOrder returns true if the json value is a supported byte order
+func isByteOrder(value interface{}) bool {
+	switch value {
+	case byteOrderABCD, byteOrderCDAB, byteOrderBADC, byteOrderDCBA:
+		return true
+	}
+	return false
+}
+
+// reorderRegisterBytes converts each value of the specified number of registers
+// between the byte order of the device and big endian. Since swapping is its own
+// inverse, the same conversion is used for reads and writes.
+func reorderRegisterBytes(modbusBytes []byte, registers int, byteOrder string) []byte {
+	wordSwap := byteOrder == byteOrderCDAB || byteOrder == byteOrderDCBA
+	byteSwap := byteOrder == byteOrderBADC || byteOrder == byteOrderDCBA
+	if !wordSwap && !byteSwap {
+		return modbusBytes
+	}
+
+	reordered := make([]byte, len(modbusBytes))
+	size := registers * 2
+	for offset := 0; offset+size <= len(modbusBytes); offset += size {
+		for register := 0; register < registers; register++ {
+			src := offset + register*2
+			dst := src
+			if wordSwap {
+				dst = offset + (registers-1-register)*2
+			}
+			if byteSwap {
+				reordered[dst], reordered[dst+1] = modbusBytes[src+1], modbusBytes[src]
+			} else {
+				reordered[dst], reordered[dst+1] = modbusBytes[src], modbusBytes[src+1]
+			}
+		}
+	}
+	return reordered
+}
+
+// translateRegistersToValues decodes the register bytes returned by the modbus
+// device into one value per data type, using the format options of the request
+func translateRegistersToValues(modbusBytes []byte, dataTypes []string, format registerFormat) ([]interface{}, error) {
+	if len(modbusBytes) < registerCount(dataTypes)*2 {
+		return nil, fmt.Errorf("modbus: response data size '%v' is less than expected '%v'", len(modbusBytes), registerCount(dataTypes)*2)
+	}
+
+	values := make([]interface{}, len(dataTypes))
+	offset := 0
+	for ndx, dataType := range dataTypes {
+		registers, _ := dataTypeSize(dataType)
+		valueBytes := modbusBytes[offset : offset+registers*2]
+		offset += registers * 2
+
+		var err error
+		switch {
+		case strings.HasPrefix(dataType, dataTypeString+":"):
+			values[ndx] = decodeString(valueBytes, format)
+		case dataType == dataTypeBitfield:
+			values[ndx] = decodeBitfield(reorderRegisterBytes(valueBytes, registers, format.byteOrder), format.bitNames)
+		case dataType == dataTypeBCD16 || dataType == dataTypeBCD32:
+			if values[ndx], err = decodeBCD(reorderRegisterBytes(valueBytes, registers, format.byteOrder)); err != nil {
+				return nil, fmt.Errorf("Value %d: %s", ndx, err.Error())
+			}
+		default:
+			values[ndx] = decodeValue(reorderRegisterBytes(valueBytes, registers, format.byteOrder), dataType)
+		}
+	}
+	return values, nil
+}
+
+// decodeValue decodes a single value of the specified data type. NaN and infinite
+// floating point values cannot be represented in json and are returned as nil.
+func decodeValue(valueBytes []byte, dataType string) interface{} {
+	switch dataType {
+	case dataTypeInt16:
+		return int16(binary.BigEndian.Uint16(valueBytes))
+	case dataTypeUint32:
+		return binary.BigEndian.Uint32(valueBytes)
+	case dataTypeInt32:
+		return int32(binary.BigEndian.Uint32(valueBytes))
+	case dataTypeFloat32:
+		return jsonFloat(float32ToFloat64(math.Float32frombits(binary.BigEndian.Uint32(valueBytes))))
+	case dataTypeUint64:
+		return binary.BigEndian.Uint64(valueBytes)
+	case dataTypeInt64:
+		return int64(binary.BigEndian.Uint64(valueBytes))
+	case dataTypeFloat64:
+		return jsonFloat(math.Float64frombits(binary.BigEndian.Uint64(valueBytes)))
+	default:
+		return binary.BigEndian.Uint16(valueBytes)
+	}
+}
+
+// jsonFloat returns nil for the floating point values that json cannot represent
+func jsonFloat(value float64) interface{} {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+	return value
+}
+
+// float32ToFloat64 widens a float32 using its shortest decimal representation, so
+// that 1.1 is returned as 1.1 rather than 1.100000023841858
+func float32ToFloat64(value float32) float64 {
+	widened, _ := strconv.ParseFloat(strconv.FormatFloat(float64(value), 'g', -1, 32), 64)
+	return widened
+}
+
+// decodeString decodes ASCII characters packed two per register, high byte first.
+// Devices that store the low byte first are handled by the byte swapping byte
+// orders (BADC and DCBA); register order is never swapped for strings. Trailing
+// NULs and spaces are removed unless trimming is disabled.
+func decodeString(valueBytes []byte, format registerFormat) string {
+	if format.byteOrder == byteOrderBADC || format.byteOrder == byteOrderDCBA {
+		valueBytes = reorderRegisterBytes(valueBytes, 1, byteOrderBADC)
+	}
+
+	value := string(valueBytes)
+	if format.trimStrings {
+		//Anything after the first NUL is padding
+		if end := strings.IndexByte(value, 0); end >= 0 {
+			value = value[:end]
+		}
+		value = strings.TrimRight(value, " ")
+	}
+	return value
+}
+
+// decodeBCD decodes packed binary coded decimal, four digits per register
+func decodeBCD(valueBytes []byte) (uint64, error) {
+	var value uint64
+	for _, b := range valueBytes {
+		high, low := b>>4, b&0x0F
+		if high > 9 || low > 9 {
+			return 0, fmt.Errorf("invalid BCD digits 0x%02X", b)
+		}
+		value = value*100 + uint64(high)*10 + uint64(low)
+	}
+	return value, nil
+}
+
+// decodeBitfield decodes the 16 bits of a register into a json object. Bits are
+// named by their position in bitNames, with bit 0 being the least significant.
+// Bits without a name are returned as Bit0 - Bit15, unless bitNames is provided,
+// in which case unnamed bits are omitted.
+func decodeBitfield(valueBytes []byte, bitNames []string) map[string]bool {
+	register := binary.BigEndian.Uint16(valueBytes)
+	bits := make(map[string]bool)
+
+	for bit := uint(0); bit < 16; bit++ {
+		name := fmt.Sprintf("Bit%d", bit)
+		if bitNames != nil {
+			if int(bit) >= len(bitNames) || bitNames[bit] == "" {
+				continue
+			}
+			name = bitNames[bit]
+		}
+		bits[name] = register&(1<<bit) != 0
+	}
+	return bits
+}
+
+// dataTypeRange returns the range of integer values that can be stored in an
+// integer, BCD or bitfield data type. The upper bound of the 64 bit types is the
+// largest float64 below 2^63 or 2^64, so that in range values convert exactly.
+func dataTypeRange(dataType string) (float64, float64) {
+	switch dataType {
+	case dataTypeInt16:
+		return math.MinInt16, math.MaxInt16
+	case dataTypeUint32:
+		return 0, math.MaxUint32
+	case dataTypeInt32:
+		return math.MinInt32, math.MaxInt32
+	case dataTypeUint64:
+		return 0, math.Nextafter(1<<64, 0)
+	case dataTypeInt64:
+		return math.MinInt64, math.Nextafter(1<<63, 0)
+	case dataTypeBCD16:
+		return 0, 9999
+	case dataTypeBCD32:
+		return 0, 99999999
+	default:
+		return 0, math.MaxUint16
+	}
+}
+
+// writeDataTypes returns the data type of each of the count values in the Data of
+// a typed register write. DataTypes must contain a data type for every value,
+// while DataType applies to all of them.
+func writeDataTypes(request *modbusRequest, count int) ([]string, error) {
+	if request.DataTypes != nil {
+		dataTypes, err := requestDataTypes(&modbusRequest{DataTypes: request.DataTypes})
+		if err != nil {
+			return nil, err
+		}
+		if len(dataTypes) != count {
+			return nil, fmt.Errorf("DataTypes must contain a data type for each of the %d Data values", count)
+		}
+		return dataTypes, nil
+	}
+
+	dataTypes, err := requestDataTypes(&modbusRequest{DataType: request.DataType})
+	if err != nil {
+		return nil, err
+	}
+	for len(dataTypes) < count {
+		dataTypes = append(dataTypes, dataTypes[0])
+	}
+	return dataTypes, nil
+}
+
+// translateValuesToRegisters encodes the values of a typed register write into
+// the register bytes sent to the modbus device. Numeric values are converted from
+// engineering units when scale is not nil.
+func translateValuesToRegisters(values []interface{}, dataTypes []string, format registerFormat, scale *engineeringScale) ([]byte, error) {
+	var modbusBytes []byte
+	for ndx, value := range values {
+		registers, _ := dataTypeSize(dataTypes[ndx])
+		valueBytes, err := encodeValue(value, dataTypes[ndx], registers, format, scale)
+		if err != nil {
+			return nil, fmt.Errorf("Data[%d] %s", ndx, err.Error())
+		}
+		if !strings.HasPrefix(dataTypes[ndx], dataTypeString+":") {
+			valueBytes = reorderRegisterBytes(valueBytes, registers, format.byteOrder)
+		}
+		modbusBytes = append(modbusBytes, valueBytes...)
+	}
+	return modbusBytes, nil
+}
+
+// encodeValue encodes a single json value as big endian bytes of the specified
+// data type
+func encodeValue(value interface{}, dataType string, registers int, format registerFormat, scale *engineeringScale) ([]byte, error) {
+	if strings.HasPrefix(dataType, dataTypeString+":") {
+		text, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("must be a string for data type %s", dataType)
+		}
+		return encodeString(text, registers, format)
+	}
+
+	if dataType == dataTypeBitfield {
+		if bits, ok := value.(map[string]interface{}); ok {
+			register, err := encodeBitfield(bits, format.bitNames)
+			if err != nil {
+				return nil, err
+			}
+			return appendUint16(nil, register), nil
+		}
+	}
+
+	number, ok := value.(float64)
+	if !ok {
+		return nil, fmt.Errorf("must be a number for data type %s", dataType)
+	}
+
+	valueBytes := make([]byte, registers*2)
+	switch dataType {
+	case dataTypeFloat32:
+		if scale != nil {
+			number = scale.unscale(number)
+		}
+		if math.Abs(number) > math.MaxFloat32 {
+			return nil, fmt.Errorf("is out of range for data type %s", dataType)
+		}
+		binary.BigEndian.PutUint32(valueBytes, math.Float32bits(float32(number)))
+		return valueBytes, nil
+	case dataTypeFloat64:
+		if scale != nil {
+			number = scale.unscale(number)
+		}
+		binary.BigEndian.PutUint64(valueBytes, math.Float64bits(number))
+		return valueBytes, nil
+	}
+
+	minValue, maxValue := dataTypeRange(dataType)
+	if scale != nil {
+		number = scale.toRaw(number, minValue, maxValue)
+	} else if number != math.Trunc(number) || number < minValue || number > maxValue {
+		return nil, fmt.Errorf("must be an integer between %.0f and %.0f for data type %s", minValue, maxValue, dataType)
+	}
+
+	switch dataType {
+	case dataTypeInt16:
+		binary.BigEndian.PutUint16(valueBytes, uint16(int16(number)))
+	case dataTypeUint32:
+		binary.BigEndian.PutUint32(valueBytes, uint32(number))
+	case dataTypeInt32:
+		binary.BigEndian.PutUint32(valueBytes, uint32(int32(number)))
+	case dataTypeUint64:
+		binary.BigEndian.PutUint64(valueBytes, uint64(number))
+	case dataTypeInt64:
+		binary.BigEndian.PutUint64(valueBytes, uint64(int64(number)))
+	case dataTypeBCD16, dataTypeBCD32:
+		encodeBCD(valueBytes, uint64(number))
+	default:
+		binary.BigEndian.PutUint16(valueBytes, uint16(number))
+	}
+	return valueBytes, nil
+}
+
+// encodeString encodes ASCII characters two per register, padded with NULs to
+// the length of the data type. The BADC and DCBA byte orders swap the characters
+// within each register, as they do when strings are read.
+func encodeString(value string, registers int, format registerFormat) ([]byte, error) {
+	if len(value) > registers*2 {
+		return nil, fmt.Errorf("exceeds the maximum length of %d characters", registers*2)
+	}
+	for ndx := 0; ndx < len(value); ndx++ {
+		if value[ndx] > 0x7F {
+			return nil, fmt.Errorf("must only contain ASCII characters")
+		}
+	}
+
+	valueBytes := make([]byte, registers*2)
+	copy(valueBytes, value)
+	if format.byteOrder == byteOrderBADC || format.byteOrder == byteOrderDCBA {
+		valueBytes = reorderRegisterBytes(valueBytes, 1, byteOrderBADC)
+	}
+	return valueBytes, nil
+}
+
+// encodeBCD encodes an integer as packed binary coded decimal, filling valueBytes
+func encodeBCD(valueBytes []byte, value uint64) {
+	for ndx := len(valueBytes) - 1; ndx >= 0; ndx-- {
+		valueBytes[ndx] = byte(value%10) | byte(value/10%10)<<4
+		value /= 100
+	}
+}
+
+// encodeBitfield encodes an object of named bits, as returned when a bitfield is
+// read, into a register. Bits that are not included are written as 0.
+func encodeBitfield(bits map[string]interface{}, bitNames []string) (uint16, error) {
+	var register uint16
+	for name, state := range bits {
+		set, ok := state.(bool)
+		if !ok {
+			return 0, fmt.Errorf("bit %s must be a boolean", name)
+		}
+
+		bit := -1
+		for ndx, bitName := range bitNames {
+			if bitName != "" && bitName == name {
+				bit = ndx
+			}
+		}
+		if bitNames == nil && strings.HasPrefix(name, "Bit") {
+			if number, err := strconv.Atoi(strings.TrimPrefix(name, "Bit")); err == nil {
+				bit = number
+			}
+		}
+		if bit < 0 || bit > 15 {
+			return 0, fmt.Errorf("bit %s is not a named bit", name)
+		}
+		if set {
+			register |= 1 << uint(bit)
+		}
+	}
+	return register, nil
+}
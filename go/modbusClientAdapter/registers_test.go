@@ -0,0 +1,435 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestDataTypeSize(t *testing.T) {
+	tests := []struct {
+		dataType string
+		size     int
+		valid    bool
+	}{
+		{dataTypeUint16, 1, true},
+		{dataTypeInt16, 1, true},
+		{dataTypeUint32, 2, true},
+		{dataTypeInt32, 2, true},
+		{dataTypeFloat32, 2, true},
+		{dataTypeUint64, 4, true},
+		{dataTypeInt64, 4, true},
+		{dataTypeFloat64, 4, true},
+		{"string:1", 1, true},
+		{"string:125", 125, true},
+		{"string:0", 0, false},
+		{"string:126", 0, false},
+		{"string", 0, false},
+		{"float16", 0, false},
+		{"", 0, false},
+	}
+
+	for _, test := range tests {
+		size, valid := dataTypeSize(test.dataType)
+		if size != test.size || valid != test.valid {
+			t.Errorf("dataTypeSize(%q) = %d, %t, want %d, %t", test.dataType, size, valid, test.size, test.valid)
+		}
+	}
+}
+
+func TestRequestDataTypes(t *testing.T) {
+	count := func(value uint16) *uint16 { return &value }
+
+	tests := []struct {
+		name    string
+		request modbusRequest
+		want    []string
+		err     string
+	}{
+		{name: "single value", request: modbusRequest{DataType: "int32"}, want: []string{"int32"}},
+		{name: "value count", request: modbusRequest{DataType: "float32", ValueCount: count(3)}, want: []string{"float32", "float32", "float32"}},
+		{name: "data types", request: modbusRequest{DataTypes: []string{"uint16", "float64", "string:4"}}, want: []string{"uint16", "float64", "string:4"}},
+		{name: "data types take precedence", request: modbusRequest{DataType: "int16", DataTypes: []string{"uint32"}}, want: []string{"uint32"}},
+		{name: "empty data types", request: modbusRequest{DataTypes: []string{}}, err: "DataTypes must be an array of data types"},
+		{name: "invalid data types", request: modbusRequest{DataTypes: []string{"uint16", "int8"}}, err: "Invalid data type int8 in DataTypes"},
+		{name: "invalid data type", request: modbusRequest{DataType: "int8"}, err: "Invalid DataType int8"},
+		{name: "zero value count", request: modbusRequest{DataType: "int16", ValueCount: count(0)}, err: "ValueCount must be an integer between 1 and 125"},
+		{name: "too many values", request: modbusRequest{DataType: "int16", ValueCount: count(126)}, err: "ValueCount must be an integer between 1 and 125"},
+	}
+
+	for _, test := range tests {
+		dataTypes, err := requestDataTypes(&test.request)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: requestDataTypes error = %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(dataTypes, test.want) {
+			t.Errorf("%s: requestDataTypes = %v, %v, want %v", test.name, dataTypes, err, test.want)
+		}
+	}
+}
+
+func TestRegisterCount(t *testing.T) {
+	if count := registerCount([]string{"uint16", "float32", "int64", "string:5"}); count != 12 {
+		t.Errorf("registerCount = %d, want 12", count)
+	}
+}
+
+func TestTranslateRegistersToValues(t *testing.T) {
+	format := registerFormat{byteOrder: byteOrderABCD, trimStrings: true}
+
+	tests := []struct {
+		dataType string
+		bytes    []byte
+		want     interface{}
+	}{
+		{dataTypeUint16, []byte{0xFF, 0xFE}, uint16(65534)},
+		{dataTypeInt16, []byte{0xFF, 0xFE}, int16(-2)},
+		{dataTypeUint32, []byte{0xFF, 0xFF, 0xFF, 0xFE}, uint32(4294967294)},
+		{dataTypeInt32, []byte{0xFF, 0xFF, 0xFF, 0xFE}, int32(-2)},
+		{dataTypeUint64, []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFE}, uint64(math.MaxUint64 - 1)},
+		{dataTypeInt64, []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFE}, int64(-2)},
+		{dataTypeInt64, []byte{0x00, 0x2B, 0xDC, 0x54, 0x5D, 0x6B, 0x4B, 0x87}, int64(12345678901234567)},
+		//1.1 is returned as its shortest float32 representation
+		{dataTypeFloat32, []byte{0x3F, 0x8C, 0xCC, 0xCD}, 1.1},
+		{dataTypeFloat32, []byte{0xC2, 0xF6, 0xE9, 0x79}, -123.456},
+		{dataTypeFloat64, []byte{0x40, 0x09, 0x21, 0xFB, 0x54, 0x44, 0x2D, 0x18}, math.Pi},
+		//NaN and infinity cannot be represented in json
+		{dataTypeFloat32, []byte{0x7F, 0xC0, 0x00, 0x00}, nil},
+		{dataTypeFloat32, []byte{0x7F, 0x80, 0x00, 0x00}, nil},
+		{dataTypeFloat64, []byte{0xFF, 0xF0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, nil},
+	}
+
+	for _, test := range tests {
+		values, err := translateRegistersToValues(test.bytes, []string{test.dataType}, format)
+		if err != nil {
+			t.Errorf("translateRegistersToValues(% x, %s) returned error: %s", test.bytes, test.dataType, err)
+			continue
+		}
+		if len(values) != 1 || !reflect.DeepEqual(values[0], test.want) {
+			t.Errorf("translateRegistersToValues(% x, %s) = %#v, want %#v", test.bytes, test.dataType, values, test.want)
+		}
+	}
+}
+
+func TestTranslateRegistersToMultipleValues(t *testing.T) {
+	format := registerFormat{byteOrder: byteOrderABCD, trimStrings: true}
+	modbusBytes := []byte{0x00, 0x07, 0xFF, 0xFF, 0xFF, 0xF9, 0x3F, 0xC0, 0x00, 0x00}
+
+	values, err := translateRegistersToValues(modbusBytes, []string{"uint16", "int32", "float32"}, format)
+	if err != nil {
+		t.Fatalf("translateRegistersToValues returned error: %s", err)
+	}
+	if want := []interface{}{uint16(7), int32(-7), 1.5}; !reflect.DeepEqual(values, want) {
+		t.Errorf("translateRegistersToValues = %#v, want %#v", values, want)
+	}
+
+	if _, err := translateRegistersToValues(modbusBytes[:8], []string{"uint16", "int32", "float32"}, format); err == nil {
+		t.Error("translateRegistersToValues of a short response did not return an error")
+	}
+}
+
+func TestReorderRegisterBytes(t *testing.T) {
+	bigEndian := []byte{0xAA, 0xBB, 0xCC, 0xDD}
+
+	tests := []struct {
+		byteOrder string
+		registers int
+		bytes     []byte
+		want      []byte
+	}{
+		{byteOrderABCD, 2, bigEndian, []byte{0xAA, 0xBB, 0xCC, 0xDD}},
+		{byteOrderCDAB, 2, bigEndian, []byte{0xCC, 0xDD, 0xAA, 0xBB}},
+		{byteOrderBADC, 2, bigEndian, []byte{0xBB, 0xAA, 0xDD, 0xCC}},
+		{byteOrderDCBA, 2, bigEndian, []byte{0xDD, 0xCC, 0xBB, 0xAA}},
+		{byteOrderCDAB, 4, []byte{1, 2, 3, 4, 5, 6, 7, 8}, []byte{7, 8, 5, 6, 3, 4, 1, 2}},
+		{byteOrderDCBA, 4, []byte{1, 2, 3, 4, 5, 6, 7, 8}, []byte{8, 7, 6, 5, 4, 3, 2, 1}},
+		//Each value of consecutive values is reordered separately
+		{byteOrderCDAB, 2, []byte{1, 2, 3, 4, 5, 6, 7, 8}, []byte{3, 4, 1, 2, 7, 8, 5, 6}},
+		{byteOrderDCBA, 1, []byte{1, 2, 3, 4}, []byte{2, 1, 4, 3}},
+		{byteOrderCDAB, 1, []byte{1, 2, 3, 4}, []byte{1, 2, 3, 4}},
+	}
+
+	for _, test := range tests {
+		got := reorderRegisterBytes(test.bytes, test.registers, test.byteOrder)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("reorderRegisterBytes(% x, %d, %s) = % x, want % x", test.bytes, test.registers, test.byteOrder, got, test.want)
+		}
+		//Reordering is its own inverse, so the same conversion is used for writes
+		if back := reorderRegisterBytes(got, test.registers, test.byteOrder); !reflect.DeepEqual(back, test.bytes) {
+			t.Errorf("reorderRegisterBytes(% x, %d, %s) is not its own inverse: % x", got, test.registers, test.byteOrder, back)
+		}
+	}
+}
+
+func TestTranslateRegistersByteOrder(t *testing.T) {
+	tests := []struct {
+		byteOrder string
+		bytes     []byte
+	}{
+		{byteOrderABCD, []byte{0x3F, 0xC0, 0x00, 0x00, 0x00, 0x01, 0xE2, 0x40}},
+		{byteOrderCDAB, []byte{0x00, 0x00, 0x3F, 0xC0, 0xE2, 0x40, 0x00, 0x01}},
+		{byteOrderBADC, []byte{0xC0, 0x3F, 0x00, 0x00, 0x01, 0x00, 0x40, 0xE2}},
+		{byteOrderDCBA, []byte{0x00, 0x00, 0xC0, 0x3F, 0x40, 0xE2, 0x01, 0x00}},
+	}
+
+	for _, test := range tests {
+		format := registerFormat{byteOrder: test.byteOrder, trimStrings: true}
+		values, err := translateRegistersToValues(test.bytes, []string{"float32", "int32"}, format)
+		if err != nil {
+			t.Errorf("%s: translateRegistersToValues returned error: %s", test.byteOrder, err)
+			continue
+		}
+		if want := []interface{}{1.5, int32(123456)}; !reflect.DeepEqual(values, want) {
+			t.Errorf("%s: translateRegistersToValues = %#v, want %#v", test.byteOrder, values, want)
+		}
+	}
+}
+
+func TestIsByteOrder(t *testing.T) {
+	for _, value := range []interface{}{"ABCD", "CDAB", "BADC", "DCBA"} {
+		if !isByteOrder(value) {
+			t.Errorf("isByteOrder(%v) = false", value)
+		}
+	}
+	for _, value := range []interface{}{"abcd", "DCAB", "", 1, nil} {
+		if isByteOrder(value) {
+			t.Errorf("isByteOrder(%v) = true", value)
+		}
+	}
+}
+
+func TestDecodeString(t *testing.T) {
+	tests := []struct {
+		bytes     []byte
+		byteOrder string
+		trim      bool
+		want      string
+	}{
+		{[]byte("PUMP-1\x00\x00"), byteOrderABCD, true, "PUMP-1"},
+		{[]byte("PUMP-1  "), byteOrderABCD, true, "PUMP-1"},
+		{[]byte("PUMP-1\x00\x00"), byteOrderABCD, false, "PUMP-1\x00\x00"},
+		//Anything after the first NUL is padding
+		{[]byte("AB\x00CD\x00\x00\x00"), byteOrderABCD, true, "AB"},
+		//Low byte first devices
+		{[]byte("UPPM1-\x00\x00"), byteOrderBADC, true, "PUMP-1"},
+		{[]byte("UPPM1-\x00\x00"), byteOrderDCBA, true, "PUMP-1"},
+		//Register order is never swapped for strings
+		{[]byte("PUMP-1\x00\x00"), byteOrderCDAB, true, "PUMP-1"},
+	}
+
+	for _, test := range tests {
+		format := registerFormat{byteOrder: test.byteOrder, trimStrings: test.trim}
+		values, err := translateRegistersToValues(test.bytes, []string{"string:4"}, format)
+		if err != nil {
+			t.Errorf("translateRegistersToValues(%q, %s) returned error: %s", test.bytes, test.byteOrder, err)
+			continue
+		}
+		if values[0] != test.want {
+			t.Errorf("translateRegistersToValues(%q, %s, trim %t) = %q, want %q", test.bytes, test.byteOrder, test.trim, values[0], test.want)
+		}
+	}
+}
+
+func TestDecodeBCD(t *testing.T) {
+	tests := []struct {
+		dataType  string
+		bytes     []byte
+		byteOrder string
+		want      uint64
+		err       string
+	}{
+		{dataTypeBCD16, []byte{0x12, 0x34}, byteOrderABCD, 1234, ""},
+		{dataTypeBCD16, []byte{0x99, 0x99}, byteOrderABCD, 9999, ""},
+		{dataTypeBCD16, []byte{0x00, 0x00}, byteOrderABCD, 0, ""},
+		{dataTypeBCD32, []byte{0x12, 0x34, 0x56, 0x78}, byteOrderABCD, 12345678, ""},
+		{dataTypeBCD32, []byte{0x56, 0x78, 0x12, 0x34}, byteOrderCDAB, 12345678, ""},
+		{dataTypeBCD16, []byte{0x34, 0x12}, byteOrderBADC, 1234, ""},
+		{dataTypeBCD16, []byte{0x12, 0x3A}, byteOrderABCD, 0, "Value 0: invalid BCD digits 0x3A"},
+		{dataTypeBCD32, []byte{0xF0, 0x00, 0x00, 0x00}, byteOrderABCD, 0, "Value 0: invalid BCD digits 0xF0"},
+	}
+
+	for _, test := range tests {
+		format := registerFormat{byteOrder: test.byteOrder}
+		values, err := translateRegistersToValues(test.bytes, []string{test.dataType}, format)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("translateRegistersToValues(% x, %s) error = %v, want %q", test.bytes, test.dataType, err, test.err)
+			}
+			continue
+		}
+		if err != nil || values[0] != test.want {
+			t.Errorf("translateRegistersToValues(% x, %s, %s) = %v, %v, want %d", test.bytes, test.dataType, test.byteOrder, values, err, test.want)
+		}
+	}
+}
+
+func TestDecodeBitfield(t *testing.T) {
+	tests := []struct {
+		name      string
+		bytes     []byte
+		byteOrder string
+		bitNames  []string
+		want      map[string]bool
+	}{
+		{
+			name:      "named bits",
+			bytes:     []byte{0x80, 0x05},
+			byteOrder: byteOrderABCD,
+			bitNames:  []string{"Running", "Fault", "Remote"},
+			want:      map[string]bool{"Running": true, "Fault": false, "Remote": true},
+		},
+		{
+			name:      "unnamed bits are omitted",
+			bytes:     []byte{0x80, 0x03},
+			byteOrder: byteOrderABCD,
+			bitNames:  []string{"Running", "", "Remote", "", "", "", "", "", "", "", "", "", "", "", "", "Alarm"},
+			want:      map[string]bool{"Running": true, "Remote": false, "Alarm": true},
+		},
+		{
+			name:      "byte swapped",
+			bytes:     []byte{0x05, 0x80},
+			byteOrder: byteOrderBADC,
+			bitNames:  []string{"Running", "Fault", "Remote"},
+			want:      map[string]bool{"Running": true, "Fault": false, "Remote": true},
+		},
+	}
+
+	for _, test := range tests {
+		format := registerFormat{byteOrder: test.byteOrder, bitNames: test.bitNames}
+		values, err := translateRegistersToValues(test.bytes, []string{dataTypeBitfield}, format)
+		if err != nil {
+			t.Errorf("%s: translateRegistersToValues returned error: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(values[0], test.want) {
+			t.Errorf("%s: translateRegistersToValues = %v, want %v", test.name, values[0], test.want)
+		}
+	}
+
+	//Without BitNames every bit is returned by position
+	bits := decodeBitfield([]byte{0x80, 0x01}, nil)
+	if len(bits) != 16 || !bits["Bit0"] || !bits["Bit15"] || bits["Bit1"] {
+		t.Errorf("decodeBitfield without BitNames = %v", bits)
+	}
+}
+
+func TestTranslateValuesToRegisters(t *testing.T) {
+	tests := []struct {
+		value     interface{}
+		dataType  string
+		byteOrder string
+		bitNames  []string
+		want      []byte
+		err       string
+	}{
+		{value: 65535.0, dataType: "uint16", want: []byte{0xFF, 0xFF}},
+		{value: -2.0, dataType: "int16", want: []byte{0xFF, 0xFE}},
+		{value: 4294967294.0, dataType: "uint32", want: []byte{0xFF, 0xFF, 0xFF, 0xFE}},
+		{value: -2.0, dataType: "int32", want: []byte{0xFF, 0xFF, 0xFF, 0xFE}},
+		{value: -2.0, dataType: "int64", want: []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFE}},
+		{value: 12345678901234567.0, dataType: "uint64", want: []byte{0x00, 0x2B, 0xDC, 0x54, 0x5D, 0x6B, 0x4B, 0x88}},
+		{value: 1.5, dataType: "float32", want: []byte{0x3F, 0xC0, 0x00, 0x00}},
+		{value: math.Pi, dataType: "float64", want: []byte{0x40, 0x09, 0x21, 0xFB, 0x54, 0x44, 0x2D, 0x18}},
+		{value: 1234.0, dataType: "bcd16", want: []byte{0x12, 0x34}},
+		{value: 12345678.0, dataType: "bcd32", want: []byte{0x12, 0x34, 0x56, 0x78}},
+		{value: "PUMP-1", dataType: "string:4", want: []byte("PUMP-1\x00\x00")},
+		{value: map[string]interface{}{"Bit0": true, "Bit15": true, "Bit3": false}, dataType: "bitfield", want: []byte{0x80, 0x01}},
+		{value: map[string]interface{}{"Running": true, "Remote": true}, dataType: "bitfield", bitNames: []string{"Running", "Fault", "Remote"}, want: []byte{0x00, 0x05}},
+		{value: 12.0, dataType: "bitfield", want: []byte{0x00, 0x0C}},
+
+		//Byte orders
+		{value: 1.5, dataType: "float32", byteOrder: byteOrderCDAB, want: []byte{0x00, 0x00, 0x3F, 0xC0}},
+		{value: 123456.0, dataType: "int32", byteOrder: byteOrderBADC, want: []byte{0x01, 0x00, 0x40, 0xE2}},
+		{value: 123456.0, dataType: "int32", byteOrder: byteOrderDCBA, want: []byte{0x40, 0xE2, 0x01, 0x00}},
+		{value: 1234.0, dataType: "bcd16", byteOrder: byteOrderBADC, want: []byte{0x34, 0x12}},
+		{value: "PUMP-1", dataType: "string:4", byteOrder: byteOrderDCBA, want: []byte("UPPM1-\x00\x00")},
+		{value: "PUMP-1", dataType: "string:4", byteOrder: byteOrderCDAB, want: []byte("PUMP-1\x00\x00")},
+
+		//Invalid values
+		{value: 65536.0, dataType: "uint16", err: "Data[0] must be an integer between 0 and 65535 for data type uint16"},
+		{value: -1.0, dataType: "uint32", err: "Data[0] must be an integer between 0 and 4294967295 for data type uint32"},
+		{value: 1.5, dataType: "int16", err: "Data[0] must be an integer between -32768 and 32767 for data type int16"},
+		{value: 10000.0, dataType: "bcd16", err: "Data[0] must be an integer between 0 and 9999 for data type bcd16"},
+		{value: 1e39, dataType: "float32", err: "Data[0] is out of range for data type float32"},
+		{value: "1", dataType: "uint16", err: "Data[0] must be a number for data type uint16"},
+		{value: true, dataType: "float32", err: "Data[0] must be a number for data type float32"},
+		{value: 1.0, dataType: "string:2", err: "Data[0] must be a string for data type string:2"},
+		{value: "PUMP-12", dataType: "string:3", err: "Data[0] exceeds the maximum length of 6 characters"},
+		{value: "PUMPÉ", dataType: "string:4", err: "Data[0] must only contain ASCII characters"},
+		{value: map[string]interface{}{"Bit16": true}, dataType: "bitfield", err: "Data[0] bit Bit16 is not a named bit"},
+		{value: map[string]interface{}{"Bit1": 1.0}, dataType: "bitfield", err: "Data[0] bit Bit1 must be a boolean"},
+		{value: map[string]interface{}{"Bit0": true}, dataType: "bitfield", bitNames: []string{"Running"}, err: "Data[0] bit Bit0 is not a named bit"},
+	}
+
+	for _, test := range tests {
+		byteOrder := test.byteOrder
+		if byteOrder == "" {
+			byteOrder = byteOrderABCD
+		}
+		format := registerFormat{byteOrder: byteOrder, bitNames: test.bitNames}
+		got, err := translateValuesToRegisters([]interface{}{test.value}, []string{test.dataType}, format, nil)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("translateValuesToRegisters(%v, %s) error = %v, want %q", test.value, test.dataType, err, test.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("translateValuesToRegisters(%v, %s, %s) = % x, %v, want % x", test.value, test.dataType, byteOrder, got, err, test.want)
+		}
+	}
+}
+
+func TestTypedValuesRoundTrip(t *testing.T) {
+	dataTypes := []string{"int16", "uint32", "float32", "int64", "float64", "bcd32", "string:3", "bitfield"}
+	values := []interface{}{-123.0, 4000000000.0, -2.5, -9007199254740993.0, 0.1, 87654321.0, "ABC", map[string]interface{}{"Bit2": true}}
+	want := []interface{}{int16(-123), uint32(4000000000), -2.5, int64(-9007199254740992), 0.1, uint64(87654321), "ABC", map[string]bool{}}
+	for bit := 0; bit < 16; bit++ {
+		want[7].(map[string]bool)[fmt.Sprintf("Bit%d", bit)] = bit == 2
+	}
+
+	for _, byteOrder := range []string{byteOrderABCD, byteOrderCDAB, byteOrderBADC, byteOrderDCBA} {
+		format := registerFormat{byteOrder: byteOrder, trimStrings: true}
+		modbusBytes, err := translateValuesToRegisters(values, dataTypes, format, nil)
+		if err != nil {
+			t.Errorf("%s: translateValuesToRegisters returned error: %s", byteOrder, err)
+			continue
+		}
+		decoded, err := translateRegistersToValues(modbusBytes, dataTypes, format)
+		if err != nil || !reflect.DeepEqual(decoded, want) {
+			t.Errorf("%s: translateRegistersToValues = %#v, %v, want %#v", byteOrder, decoded, err, want)
+		}
+	}
+}
+
+func TestWriteDataTypes(t *testing.T) {
+	tests := []struct {
+		name    string
+		request modbusRequest
+		count   int
+		want    []string
+		err     string
+	}{
+		{name: "data type applies to every value", request: modbusRequest{DataType: "float32"}, count: 3, want: []string{"float32", "float32", "float32"}},
+		{name: "data types", request: modbusRequest{DataTypes: []string{"uint16", "string:2"}}, count: 2, want: []string{"uint16", "string:2"}},
+		{name: "too few data types", request: modbusRequest{DataTypes: []string{"uint16"}}, count: 2, err: "DataTypes must contain a data type for each of the 2 Data values"},
+		{name: "invalid data type", request: modbusRequest{DataType: "int8"}, count: 1, err: "Invalid DataType int8"},
+	}
+
+	for _, test := range tests {
+		dataTypes, err := writeDataTypes(&test.request, test.count)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: writeDataTypes error = %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(dataTypes, test.want) {
+			t.Errorf("%s: writeDataTypes = %v, %v, want %v", test.name, dataTypes, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// reportFields are the fields of a tag, or defaults of a poll group, that control
+// when the values of the tag are published
+var reportFields = []string{"Deadband", "DeadbandPercent", "MaxSilence"}
+
+// reportPolicy determines which values of a tag are published. Values are
+// published by exception: when the value changes by more than the deadbands, when
+// the quality of the tag changes, or when no value has been published for
+// maxSilence.
+type reportPolicy struct {
+	deadband        float64       //Absolute change required to publish, 0 for any change
+	deadbandPercent float64       //Change required, as a percentage of the value last published
+	maxSilence      time.Duration //Longest time between published values, 0 to publish only changes
+}
+
+// reportConfig is the json structure of the report fields of a tag or poll group
+type reportConfig struct {
+	Deadband        *float64
+	DeadbandPercent *float64
+	MaxSilence      *float64
+}
+
+// parseReportConfig removes the report fields from the fields of a tag or poll
+// group and returns them
+func parseReportConfig(fields map[string]json.RawMessage) (reportConfig, error) {
+	reportJSON := make(map[string]json.RawMessage)
+	for _, field := range reportFields {
+		if value, ok := fields[field]; ok {
+			reportJSON[field] = value
+			delete(fields, field)
+		}
+	}
+
+	config := reportConfig{}
+	if len(reportJSON) == 0 {
+		return config, nil
+	}
+	marshalled, _ := json.Marshal(reportJSON)
+	if err := strictUnmarshal(marshalled, &config); err != nil {
+		return config, err
+	}
+	return config, config.validate()
+}
+
+// validate returns an error if any of the report fields are negative
+func (config reportConfig) validate() error {
+	for _, field := range []struct {
+		name  string
+		value *float64
+	}{
+		{"Deadband", config.Deadband},
+		{"DeadbandPercent", config.DeadbandPercent},
+		{"MaxSilence", config.MaxSilence},
+	} {
+		if field.value != nil && *field.value < 0 {
+			return fmt.Errorf("%s must not be negative", field.name)
+		}
+	}
+	return nil
+}
+
+// reportPolicy returns the policy specified by the config, using the defaults for
+// the fields it does not specify
+func (config reportConfig) reportPolicy(defaults reportConfig) reportPolicy {
+	policy := reportPolicy{}
+	if value := firstFloat(config.Deadband, defaults.Deadband); value != nil {
+		policy.deadband = *value
+	}
+	if value := firstFloat(config.DeadbandPercent, defaults.DeadbandPercent); value != nil {
+		policy.deadbandPercent = *value
+	}
+	if value := firstFloat(config.MaxSilence, defaults.MaxSilence); value != nil {
+		policy.maxSilence = time.Duration(*value * float64(time.Second))
+	}
+	return policy
+}
+
+func firstFloat(values ...*float64) *float64 {
+	for _, value := range values {
+		if value != nil {
+			return value
+		}
+	}
+	return nil
+}
+
+// tagReport is the value of a tag that was last published, and when
+type tagReport struct {
+	value       tagValue
+	publishedAt time.Time
+}
+
+// shouldReport returns true if a value read for a tag should be published, given
+// the value last published for the tag
+func (policy reportPolicy) shouldReport(last *tagReport, value tagValue, now time.Time) bool {
+	switch {
+	case last == nil:
+		return true
+	case last.value.Quality != value.Quality:
+		return true
+	case policy.maxSilence > 0 && now.Sub(last.publishedAt) >= policy.maxSilence:
+		return true
+	}
+	return policy.valueChanged(last.value.Value, value.Value)
+}
+
+// valueChanged returns true if the current value differs from the last value
+// published by more than the deadbands. Tags that read several values have
+// changed when any of their values has changed. Values that are not numeric,
+// such as coils, strings and bitfields, have changed when they are not equal.
+func (policy reportPolicy) valueChanged(last interface{}, current interface{}) bool {
+	lastValues := reflect.ValueOf(last)
+	currentValues := reflect.ValueOf(current)
+	if lastValues.Kind() == reflect.Slice && currentValues.Kind() == reflect.Slice {
+		if lastValues.Len() != currentValues.Len() {
+			return true
+		}
+		for ndx := 0; ndx < currentValues.Len(); ndx++ {
+			if policy.valueChanged(lastValues.Index(ndx).Interface(), currentValues.Index(ndx).Interface()) {
+				return true
+			}
+		}
+		return false
+	}
+
+	lastNumber, lastOk := numericValue(last)
+	currentNumber, currentOk := numericValue(current)
+	if !lastOk || !currentOk {
+		return !reflect.DeepEqual(last, current)
+	}
+
+	change := math.Abs(currentNumber - lastNumber)
+	if policy.deadband == 0 && policy.deadbandPercent == 0 {
+		return change != 0
+	}
+	if policy.deadband > 0 && change > policy.deadband {
+		return true
+	}
+	return policy.deadbandPercent > 0 && change > math.Abs(lastNumber)*policy.deadbandPercent/100
+}
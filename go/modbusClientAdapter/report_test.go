@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValueChanged(t *testing.T) {
+	anyChange := reportPolicy{}
+	absolute := reportPolicy{deadband: 0.5}
+	percent := reportPolicy{deadbandPercent: 10}
+	both := reportPolicy{deadband: 5, deadbandPercent: 10}
+
+	tests := []struct {
+		name    string
+		policy  reportPolicy
+		last    interface{}
+		current interface{}
+		want    bool
+	}{
+		{"unchanged", anyChange, uint16(1), uint16(1), false},
+		{"any change", anyChange, uint16(1), uint16(2), true},
+		{"within deadband", absolute, 10.0, 10.5, false},
+		{"exceeds deadband", absolute, 10.0, 10.6, true},
+		{"decrease exceeds deadband", absolute, 10.0, 9.4, true},
+		{"different integer types", absolute, int16(-3), int32(-4), true},
+		{"within percent deadband", percent, 100.0, 109.0, false},
+		{"exceeds percent deadband", percent, 100.0, 89.0, true},
+		{"percent deadband of negative value", percent, -100.0, -109.0, false},
+		{"percent deadband of zero", percent, 0.0, 0.1, true},
+		{"exceeds either deadband", both, 100.0, 106.0, true},
+		{"within both deadbands", both, 100.0, 104.0, false},
+		{"exceeds percent deadband only", both, 10.0, 12.0, true},
+		{"unchanged values", absolute, []uint16{1, 2}, []uint16{1, 2}, false},
+		{"changed value", absolute, []uint16{1, 2}, []uint16{1, 3}, true},
+		{"values within deadband", absolute, []interface{}{1.0, 2.0}, []interface{}{1.5, 2.0}, false},
+		{"number of values changed", absolute, []interface{}{1.0}, []interface{}{1.0, 2.0}, true},
+		{"unchanged coils", anyChange, []bool{true, false}, []bool{true, false}, false},
+		{"changed coil", absolute, []bool{true, false}, []bool{true, true}, true},
+		{"unchanged string", absolute, "pump", "pump", false},
+		{"changed string", absolute, "pump", "fan", true},
+		{"unchanged bitfield", absolute, map[string]bool{"Alarm": true}, map[string]bool{"Alarm": true}, false},
+		{"changed bitfield", absolute, map[string]bool{"Alarm": true}, map[string]bool{"Alarm": false}, true},
+		{"value after none", absolute, nil, 1.0, true},
+		{"no value", absolute, nil, nil, false},
+	}
+
+	for _, test := range tests {
+		if got := test.policy.valueChanged(test.last, test.current); got != test.want {
+			t.Errorf("%s: valueChanged(%v, %v) = %t, want %t", test.name, test.last, test.current, got, test.want)
+		}
+	}
+}
+
+func TestShouldReport(t *testing.T) {
+	now := time.Now()
+	last := &tagReport{value: tagValue{Value: 1.0, Quality: qualityGood}, publishedAt: now.Add(-2 * time.Second)}
+
+	tests := []struct {
+		name   string
+		policy reportPolicy
+		last   *tagReport
+		value  tagValue
+		want   bool
+	}{
+		{"first value", reportPolicy{deadband: 100}, nil, tagValue{Value: 1.0, Quality: qualityGood}, true},
+		{"unchanged", reportPolicy{}, last, tagValue{Value: 1.0, Quality: qualityGood}, false},
+		{"within deadband", reportPolicy{deadband: 100}, last, tagValue{Value: 2.0, Quality: qualityGood}, false},
+		{"quality changed", reportPolicy{deadband: 100}, last, tagValue{Quality: qualityBad}, true},
+		{"before MaxSilence", reportPolicy{deadband: 100, maxSilence: 3 * time.Second}, last, tagValue{Value: 2.0, Quality: qualityGood}, false},
+		{"MaxSilence elapsed", reportPolicy{deadband: 100, maxSilence: 2 * time.Second}, last, tagValue{Value: 1.0, Quality: qualityGood}, true},
+	}
+
+	for _, test := range tests {
+		if got := test.policy.shouldReport(test.last, test.value, now); got != test.want {
+			t.Errorf("%s: shouldReport = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseReportConfig(t *testing.T) {
+	float := func(value float64) *float64 { return &value }
+
+	tests := []struct {
+		fields string
+		want   reportConfig
+		err    string
+	}{
+		{`{"Name":"level"}`, reportConfig{}, ""},
+		{`{"Name":"level","Deadband":0.5,"MaxSilence":60}`, reportConfig{Deadband: float(0.5), MaxSilence: float(60)}, ""},
+		{`{"DeadbandPercent":0}`, reportConfig{DeadbandPercent: float(0)}, ""},
+		{`{"Deadband":-1}`, reportConfig{}, "Deadband must not be negative"},
+		{`{"MaxSilence":-1}`, reportConfig{}, "MaxSilence must not be negative"},
+		{`{"Deadband":"x"}`, reportConfig{}, "Deadband must be a number"},
+	}
+
+	for _, test := range tests {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(test.fields), &fields); err != nil {
+			t.Fatal(err)
+		}
+		config, err := parseReportConfig(fields)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("parseReportConfig(%s) error = %v, want %q", test.fields, err, test.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(config, test.want) {
+			t.Errorf("parseReportConfig(%s) = %+v, %v, want %+v", test.fields, config, err, test.want)
+		}
+		for _, field := range reportFields {
+			if _, ok := fields[field]; ok {
+				t.Errorf("parseReportConfig(%s) did not remove %s", test.fields, field)
+			}
+		}
+	}
+}
+
+func TestReportConfigPolicy(t *testing.T) {
+	float := func(value float64) *float64 { return &value }
+	defaults := reportConfig{Deadband: float(1), MaxSilence: float(1.5)}
+
+	tests := []struct {
+		config reportConfig
+		want   reportPolicy
+	}{
+		{reportConfig{}, reportPolicy{deadband: 1, maxSilence: 1500 * time.Millisecond}},
+		{reportConfig{Deadband: float(0)}, reportPolicy{deadband: 0, maxSilence: 1500 * time.Millisecond}},
+		{reportConfig{DeadbandPercent: float(5), MaxSilence: float(60)}, reportPolicy{deadband: 1, deadbandPercent: 5, maxSilence: time.Minute}},
+	}
+
+	for _, test := range tests {
+		if got := test.config.reportPolicy(defaults); got != test.want {
+			t.Errorf("reportPolicy(%+v) = %+v, want %+v", test.config, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	modbus "github.com/goburrow/modbus"
+)
+
+// apiVersion is the version of the request and response formats. Requests that
+// omit Version are treated as the current version.
+const apiVersion = 1
+
+// Limits on the number of coils and registers accessed by a single request
+const (
+	maxReadCoils          = 2000
+	maxWriteCoils         = 1968
+	maxReadRegisters      = 125
+	maxWriteRegisters     = 123
+	maxReadWriteRegisters = 121
+)
+
+// modbusRequest is a request received on the {topicRoot}/request topic. The json
+// schema of the request is published in schema/modbus-request.schema.json.
+type modbusRequest struct {
+	Version      int           `json:"Version,omitempty"`
+	ModbusHost   string        `json:"ModbusHost,omitempty"`
+	UnitID       *uint8        `json:"UnitID,omitempty"`
+	FunctionCode *uint8        `json:"FunctionCode,omitempty"`
+	StartAddress *uint16       `json:"StartAddress,omitempty"`
+	AddressCount *uint16       `json:"AddressCount,omitempty"`
+	Data         []interface{} `json:"Data,omitempty"`
+
+	//Typed register values
+	DataType    string    `json:"DataType,omitempty"`
+	DataTypes   []string  `json:"DataTypes,omitempty"`
+	ValueCount  *uint16   `json:"ValueCount,omitempty"`
+	ByteOrder   string    `json:"ByteOrder,omitempty"`
+	TrimStrings *bool     `json:"TrimStrings,omitempty"`
+	BitNames    []*string `json:"BitNames,omitempty"`
+
+	//Engineering unit scaling
+	Scale     *float64 `json:"Scale,omitempty"`
+	Offset    *float64 `json:"Offset,omitempty"`
+	MinValue  *float64 `json:"MinValue,omitempty"`
+	MaxValue  *float64 `json:"MaxValue,omitempty"`
+	Precision *uint8   `json:"Precision,omitempty"`
+	Units     string   `json:"Units,omitempty"`
+
+	//Function code specific fields
+	WriteStartAddress *uint16      `json:"WriteStartAddress,omitempty"`
+	WriteAddressCount *uint16      `json:"WriteAddressCount,omitempty"`
+	AndMask           *uint16      `json:"AndMask,omitempty"`
+	OrMask            *uint16      `json:"OrMask,omitempty"`
+	ReadDeviceIDCode  *uint8       `json:"ReadDeviceIDCode,omitempty"`
+	ObjectID          *uint8       `json:"ObjectID,omitempty"`
+	SubFunction       *uint16      `json:"SubFunction,omitempty"`
+	FileRecords       []fileRecord `json:"FileRecords,omitempty"`
+
+	//Raw requests, identified by the presence of RawPDU, which may be empty
+	RawPDU      *string `json:"RawPDU,omitempty"`
+	RawEncoding string  `json:"RawEncoding,omitempty"`
+}
+
+// modbusResponse is published to the {topicRoot}/response topic, or the
+// {topicRoot}/error topic when Error is set. The fields of the request are
+// returned along with the results. The json schema of the response is published
+// in schema/modbus-response.schema.json.
+type modbusResponse struct {
+	modbusRequest
+	Version              int                    `json:"Version"`
+	Data                 interface{}            `json:"Data,omitempty"`
+	FIFOCount            *int                   `json:"FIFOCount,omitempty"`
+	ExceptionStatus      map[string]interface{} `json:"ExceptionStatus,omitempty"`
+	Diagnostics          map[string]interface{} `json:"Diagnostics,omitempty"`
+	ServerID             map[string]interface{} `json:"ServerID,omitempty"`
+	DeviceIdentification map[string]string      `json:"DeviceIdentification,omitempty"`
+	ConformityLevel      *byte                  `json:"ConformityLevel,omitempty"`
+	RawResponse          string                 `json:"RawResponse,omitempty"`
+	Success              bool                   `json:"success"`
+	Error                *responseError         `json:"error,omitempty"`
+	Request              []byte                 `json:"request,omitempty"`
+	Timestamp            string                 `json:"timestamp"`
+	SiteID               string                 `json:"SiteID,omitempty"`
+}
+
+// responseError describes why a request failed. The code is the modbus exception
+// code, a transport error code, or 0 for invalid requests. Internal errors are
+// identified by a fingerprint of the code that failed.
+type responseError struct {
+	Code        int    `json:"code"`
+	Message     string `json:"message,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// requestError is a validation error, along with the error code to report it with
+type requestError struct {
+	code    int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// newRequestError returns a validation error with the specified error code
+func newRequestError(code int, format string, args ...interface{}) error {
+	return &requestError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// requestErrorCode returns the error code of a validation error
+func requestErrorCode(err error) int {
+	if reqErr, ok := err.(*requestError); ok {
+		return reqErr.code
+	}
+	return 0
+}
+
+// newModbusResponse returns a response to the request, which echoes its fields
+func newModbusResponse(request *modbusRequest) *modbusResponse {
+	response := &modbusResponse{Version: apiVersion}
+	if request != nil {
+		response.modbusRequest = *request
+		if request.Data != nil {
+			response.Data = request.Data
+		}
+	}
+	return response
+}
+
+// addErrorToResponse marks the response as failed with the error message and code
+func addErrorToResponse(response *modbusResponse, errMsg string, errCode int) {
+	response.Success = false
+	response.Error = &responseError{Code: errCode, Message: errMsg}
+}
+
+// decodeRequest strictly decodes a request. Fields that are not part of the
+// request, and fields of the wrong type or outside the range of their type, are
+// rejected. The device profile of the ModbusHost provides the defaults for the
+// fields that the request does not specify.
+func decodeRequest(payload []byte) (*modbusRequest, error) {
+	request := &modbusRequest{}
+	if err := strictUnmarshal(payload, request); err != nil {
+		return nil, err
+	}
+
+	if profile := deviceProfile(request.ModbusHost); profile != nil {
+		//Decode the profile first, so that the fields of the request take precedence
+		host := request.ModbusHost
+		request = &modbusRequest{}
+		if err := strictUnmarshal(profile, request); err != nil {
+			return nil, fmt.Errorf("Device profile for %s is invalid: %s", host, err.Error())
+		}
+		if err := strictUnmarshal(payload, request); err != nil {
+			return nil, err
+		}
+	}
+	return request, nil
+}
+
+// strictUnmarshal decodes a single json object, rejecting unknown fields
+func strictUnmarshal(payload []byte, value interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(value); err != nil {
+		return describeDecodeError(err)
+	}
+	if decoder.More() {
+		return fmt.Errorf("Request must contain a single json object")
+	}
+	return nil
+}
+
+// describeDecodeError converts json decoding errors into messages that name the
+// invalid field and the values it accepts
+func describeDecodeError(err error) error {
+	switch e := err.(type) {
+	case *json.UnmarshalTypeError:
+		if e.Field == "" {
+			return fmt.Errorf("Request must be a json object")
+		}
+		return fmt.Errorf("%s must be %s", e.Field, describeType(e.Type))
+	case *json.SyntaxError:
+		return fmt.Errorf("Error encountered unmarshalling json: %s", e.Error())
+	}
+
+	//Unknown fields are reported as: json: unknown field "Name"
+	if strings.HasPrefix(err.Error(), "json: unknown field ") {
+		return fmt.Errorf("Unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	}
+	return fmt.Errorf("Error encountered unmarshalling json: %s", err.Error())
+}
+
+// describeType describes the json values accepted for a go type
+func describeType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return describeType(t.Elem())
+	case reflect.Uint8:
+		return "an integer between 0 and 255"
+	case reflect.Uint16:
+		return "an integer between 0 and 65535"
+	case reflect.Int:
+		return "an integer"
+	case reflect.Float64:
+		return "a number"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice:
+		return "an array"
+	case reflect.Struct, reflect.Map:
+		return "an object"
+	}
+	return t.String()
+}
+
+// validateRequest validates a decoded request, completing the fields that are
+// calculated from others, such as the AddressCount of typed register reads
+func validateRequest(request *modbusRequest) error {
+	if request.ModbusHost == "" {
+		return newRequestError(0, "ModbusHost is required")
+	}
+	if request.Version != 0 && request.Version != apiVersion {
+		return newRequestError(0, "Version %d is not supported, the current version is %d", request.Version, apiVersion)
+	}
+	if request.ByteOrder != "" && !isByteOrder(request.ByteOrder) {
+		return newRequestError(0, "ByteOrder must be one of ABCD, CDAB, BADC or DCBA")
+	}
+	if request.FunctionCode == nil {
+		return newRequestError(0, "FunctionCode is required")
+	}
+
+	functionCode := uint16(*request.FunctionCode)
+	if request.RawPDU != nil {
+		//Raw requests are sent as is, allowing vendor specific function codes
+		if functionCode < 1 || functionCode > 127 {
+			return newRequestError(modbus.ExceptionCodeIllegalFunction, "FunctionCode must be an integer between 1 and 127 for raw requests")
+		}
+		encoding, err := rawEncoding(request.RawEncoding)
+		if err != nil {
+			return newRequestError(0, err.Error())
+		}
+		if _, err := decodeRawPDU(*request.RawPDU, encoding); err != nil {
+			return newRequestError(0, err.Error())
+		}
+		return nil
+	}
+
+	switch functionCode {
+	case modbus.FuncCodeReadDiscreteInputs, modbus.FuncCodeReadCoils, modbus.FuncCodeWriteSingleCoil,
+		modbus.FuncCodeWriteMultipleCoils, modbus.FuncCodeReadInputRegisters, modbus.FuncCodeReadHoldingRegisters,
+		modbus.FuncCodeWriteSingleRegister, modbus.FuncCodeWriteMultipleRegisters, modbus.FuncCodeMaskWriteRegister,
+		modbus.FuncCodeReadWriteMultipleRegisters, modbus.FuncCodeReadFIFOQueue, funcCodeEncapsulatedInterface,
+		funcCodeReadExceptionStatus, funcCodeDiagnostics, funcCodeReportServerID, funcCodeReadFileRecord,
+		funcCodeWriteFileRecord:
+	default:
+		return newRequestError(modbus.ExceptionCodeIllegalFunction, "Invalid FunctionCode")
+	}
+
+	if request.StartAddress == nil && requiresStartAddress(functionCode) {
+		return newRequestError(0, "StartAddress is required")
+	}
+
+	readsRegisters := functionCode == modbus.FuncCodeReadHoldingRegisters ||
+		functionCode == modbus.FuncCodeReadInputRegisters ||
+		functionCode == modbus.FuncCodeReadWriteMultipleRegisters
+	writesRegisters := functionCode == modbus.FuncCodeWriteSingleRegister ||
+		functionCode == modbus.FuncCodeWriteMultipleRegisters ||
+		functionCode == modbus.FuncCodeReadWriteMultipleRegisters
+
+	//For typed register reads, the register count is calculated from the data types.
+	//An AddressCount that does not match the data types is rejected.
+	if request.DataType != "" || request.DataTypes != nil {
+		if !readsRegisters && !writesRegisters {
+			return newRequestError(0, "DataType is only supported for function codes 3, 4, 6, 16 and 23")
+		}
+		dataTypes, err := requestDataTypes(request)
+		if err != nil {
+			return newRequestError(0, err.Error())
+		}
+		if err := validateRegisterFormat(request); err != nil {
+			return newRequestError(0, err.Error())
+		}
+		if readsRegisters {
+			addressCount := uint16(registerCount(dataTypes))
+			if request.AddressCount != nil && *request.AddressCount != 0 && *request.AddressCount != addressCount {
+				return newRequestError(modbus.ExceptionCodeIllegalDataValue, "AddressCount must match the %d registers of the data types", addressCount)
+			}
+			request.AddressCount = &addressCount
+		}
+	}
+
+	if isScaled(request) || request.Units != "" {
+		if !readsRegisters && !writesRegisters {
+			return newRequestError(0, "Scale and Offset are only supported for function codes 3, 4, 6, 16 and 23")
+		}
+		if err := validateScale(request); err != nil {
+			return newRequestError(0, err.Error())
+		}
+	}
+
+	switch functionCode {
+	case modbus.FuncCodeWriteSingleCoil, modbus.FuncCodeWriteMultipleCoils, modbus.FuncCodeWriteSingleRegister,
+		modbus.FuncCodeWriteMultipleRegisters, modbus.FuncCodeReadWriteMultipleRegisters:
+		if len(request.Data) == 0 {
+			return newRequestError(0, "Data is required for 'write' function codes")
+		}
+	}
+
+	//Register writes are encoded up front so that invalid values are reported
+	//before anything is sent to the device
+	if writesRegisters {
+		writeData, err := registerWriteData(request, requestRegisterFormat(request).byteOrder)
+		if err != nil {
+			return newRequestError(modbus.ExceptionCodeIllegalDataValue, err.Error())
+		}
+		if err := validateWriteRegisterCount(request, len(writeData)/2); err != nil {
+			return newRequestError(modbus.ExceptionCodeIllegalDataValue, err.Error())
+		}
+	}
+
+	switch functionCode {
+	case modbus.FuncCodeWriteSingleCoil:
+		if len(request.Data) != 1 {
+			return newRequestError(modbus.ExceptionCodeIllegalDataValue, "Data must contain a single coil value for function code 5")
+		}
+		if _, err := coilValues(request.Data); err != nil {
+			return newRequestError(modbus.ExceptionCodeIllegalDataValue, err.Error())
+		}
+	case modbus.FuncCodeWriteMultipleCoils:
+		if _, err := coilValues(request.Data); err != nil {
+			return newRequestError(modbus.ExceptionCodeIllegalDataValue, err.Error())
+		}
+		if request.AddressCount == nil {
+			addressCount := uint16(len(request.Data))
+			request.AddressCount = &addressCount
+		} else if int(*request.AddressCount) != len(request.Data) {
+			return newRequestError(modbus.ExceptionCodeIllegalDataValue, "AddressCount must match the number of Data values")
+		}
+	}
+
+	if err := validateAddressRange(request, functionCode); err != nil {
+		return err
+	}
+
+	switch functionCode {
+	case modbus.FuncCodeReadWriteMultipleRegisters:
+		if request.WriteStartAddress == nil {
+			return newRequestError(0, "WriteStartAddress is required for function code 23")
+		}
+		if int(*request.WriteStartAddress)+int(*request.WriteAddressCount) > 0x10000 {
+			return newRequestError(modbus.ExceptionCodeIllegalDataAddress, "The registers written must be between address 0 and 65535")
+		}
+	case funcCodeEncapsulatedInterface:
+		if request.ReadDeviceIDCode != nil &&
+			(*request.ReadDeviceIDCode < readDeviceIDBasic || *request.ReadDeviceIDCode > readDeviceIDIndividual) {
+			return newRequestError(modbus.ExceptionCodeIllegalDataValue, "ReadDeviceIDCode must be 1 (basic), 2 (regular), 3 (extended) or 4 (individual)")
+		}
+	case funcCodeReadFileRecord, funcCodeWriteFileRecord:
+		if err := validateFileRecords(request.FileRecords, functionCode == funcCodeWriteFileRecord); err != nil {
+			return newRequestError(modbus.ExceptionCodeIllegalDataValue, err.Error())
+		}
+	case funcCodeDiagnostics:
+		if request.SubFunction == nil || !isDiagnosticsSubFunction(*request.SubFunction) {
+			return newRequestError(modbus.ExceptionCodeIllegalFunction, "A supported SubFunction is required for function code 8")
+		}
+		if request.Data != nil && (len(request.Data) != 1 || !isIntegerInRange(request.Data[0], 0, 0xFFFF)) {
+			return newRequestError(modbus.ExceptionCodeIllegalDataValue, "Data must contain a single value between 0 and 65535 for function code 8")
+		}
+	case modbus.FuncCodeMaskWriteRegister:
+		if request.AndMask == nil || request.OrMask == nil {
+			return newRequestError(0, "AndMask and OrMask are required for function code 22 and must be integers between 0 and 65535")
+		}
+	}
+
+	return nil
+}
+
+// validateAddressRange validates that AddressCount is provided when required and
+// is within the limits of the function code, and that the coils or registers
+// accessed do not extend beyond address 65535
+func validateAddressRange(request *modbusRequest, functionCode uint16) error {
+	var maxCount uint16
+	switch functionCode {
+	case modbus.FuncCodeReadDiscreteInputs, modbus.FuncCodeReadCoils:
+		maxCount = maxReadCoils
+	case modbus.FuncCodeWriteMultipleCoils:
+		maxCount = maxWriteCoils
+	case modbus.FuncCodeReadInputRegisters, modbus.FuncCodeReadHoldingRegisters, modbus.FuncCodeReadWriteMultipleRegisters:
+		maxCount = maxReadRegisters
+	case modbus.FuncCodeWriteMultipleRegisters:
+		maxCount = maxWriteRegisters
+	default:
+		return nil
+	}
+
+	if request.AddressCount == nil {
+		return newRequestError(0, "AddressCount is required")
+	}
+	count := *request.AddressCount
+	if count < 1 || count > maxCount {
+		return newRequestError(modbus.ExceptionCodeIllegalDataValue, "AddressCount must be between 1 and %d for function code %d", maxCount, functionCode)
+	}
+	if int(*request.StartAddress)+int(count) > 0x10000 {
+		return newRequestError(modbus.ExceptionCodeIllegalDataAddress, "The addresses accessed must be between 0 and 65535")
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"testing"
+
+	modbus "github.com/goburrow/modbus"
+)
+
+func TestDecodeRequest(t *testing.T) {
+	tests := []struct {
+		payload string
+		err     string
+	}{
+		{payload: `{"ModbusHost":"192.168.0.9:502","FunctionCode":3,"StartAddress":0,"AddressCount":2}`},
+		{payload: `{"ModbusHost":"192.168.0.9:502","FunctionCode":3,"StartAddress":0,"AddressCount":2,"Adress":1}`, err: `Unknown field "Adress"`},
+		{payload: `{"ModbusHost":"192.168.0.9:502","FunctionCode":"3"}`, err: "FunctionCode must be an integer between 0 and 255"},
+		{payload: `{"ModbusHost":"192.168.0.9:502","FunctionCode":256}`, err: "FunctionCode must be an integer between 0 and 255"},
+		{payload: `{"ModbusHost":"192.168.0.9:502","FunctionCode":3.5}`, err: "FunctionCode must be an integer between 0 and 255"},
+		{payload: `{"ModbusHost":"192.168.0.9:502","StartAddress":-1}`, err: "StartAddress must be an integer between 0 and 65535"},
+		{payload: `{"ModbusHost":"192.168.0.9:502","StartAddress":65536}`, err: "StartAddress must be an integer between 0 and 65535"},
+		{payload: `{"ModbusHost":"192.168.0.9:502","UnitID":-1}`, err: "UnitID must be an integer between 0 and 255"},
+		{payload: `{"ModbusHost":502}`, err: "ModbusHost must be a string"},
+		{payload: `{"ModbusHost":"192.168.0.9:502","Data":5}`, err: "Data must be an array"},
+		{payload: `{"ModbusHost":"192.168.0.9:502","TrimStrings":"yes"}`, err: "TrimStrings must be a boolean"},
+		{payload: `{"ModbusHost":"192.168.0.9:502","Scale":"0.1"}`, err: "Scale must be a number"},
+		{payload: `[{"ModbusHost":"192.168.0.9:502"}]`, err: "Request must be a json object"},
+		{payload: `{"ModbusHost":"192.168.0.9:502"}{}`, err: "Request must contain a single json object"},
+		{payload: `{"ModbusHost":`, err: "Error encountered unmarshalling json: unexpected EOF"},
+	}
+
+	for _, test := range tests {
+		_, err := decodeRequest([]byte(test.payload))
+		if test.err == "" && err != nil {
+			t.Errorf("decodeRequest(%s) returned error: %s", test.payload, err)
+		}
+		if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("decodeRequest(%s) error = %v, want %q", test.payload, err, test.err)
+		}
+	}
+}
+
+func TestDecodeRequestProfile(t *testing.T) {
+	defer func(profiles map[string]map[string]interface{}) { deviceProfiles = profiles }(deviceProfiles)
+	deviceProfiles = map[string]map[string]interface{}{
+		"192.168.0.9:502":  {"ByteOrder": "CDAB"},
+		"192.168.0.10:502": {"ByteOrder": 1},
+	}
+
+	tests := []struct {
+		payload   string
+		byteOrder string
+		err       string
+	}{
+		{payload: `{"ModbusHost":"192.168.0.9:502","FunctionCode":3,"StartAddress":0,"DataType":"float32"}`, byteOrder: "CDAB"},
+		{payload: `{"ModbusHost":"192.168.0.9:502","FunctionCode":3,"StartAddress":0,"DataType":"float32","ByteOrder":"DCBA"}`, byteOrder: "DCBA"},
+		{payload: `{"ModbusHost":"192.168.0.11:502","FunctionCode":3,"StartAddress":0,"DataType":"float32"}`, byteOrder: ""},
+		{payload: `{"ModbusHost":"192.168.0.10:502","FunctionCode":3}`, err: "Device profile for 192.168.0.10:502 is invalid: ByteOrder must be a string"},
+		{payload: `{"ModbusHost":"192.168.0.9:502","FunctionCode":3,"Unknown":true}`, err: `Unknown field "Unknown"`},
+	}
+
+	for _, test := range tests {
+		request, err := decodeRequest([]byte(test.payload))
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("decodeRequest(%s) error = %v, want %q", test.payload, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("decodeRequest(%s) returned error: %s", test.payload, err)
+			continue
+		}
+		if request.ByteOrder != test.byteOrder {
+			t.Errorf("decodeRequest(%s) ByteOrder = %q, want %q", test.payload, request.ByteOrder, test.byteOrder)
+		}
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		err     string
+		code    int
+	}{
+		{"read coils", `{"ModbusHost":"h:502","FunctionCode":1,"StartAddress":0,"AddressCount":2000}`, "", 0},
+		{"read registers", `{"ModbusHost":"h:502","FunctionCode":3,"StartAddress":65411,"AddressCount":125}`, "", 0},
+		{"write coil", `{"ModbusHost":"h:502","FunctionCode":5,"StartAddress":0,"Data":[true]}`, "", 0},
+		{"write registers", `{"ModbusHost":"h:502","FunctionCode":16,"StartAddress":0,"Data":[1,2,3]}`, "", 0},
+		{"read write registers", `{"ModbusHost":"h:502","FunctionCode":23,"StartAddress":0,"AddressCount":2,"WriteStartAddress":10,"Data":[1,2]}`, "", 0},
+		{"mask write", `{"ModbusHost":"h:502","FunctionCode":22,"StartAddress":0,"AndMask":255,"OrMask":256}`, "", 0},
+		{"diagnostics", `{"ModbusHost":"h:502","FunctionCode":8,"SubFunction":0,"Data":[42]}`, "", 0},
+		{"device identification", `{"ModbusHost":"h:502","FunctionCode":43,"ReadDeviceIDCode":2}`, "", 0},
+
+		{"missing host", `{"FunctionCode":3,"StartAddress":0,"AddressCount":1}`, "ModbusHost is required", 0},
+		{"unsupported version", `{"Version":2,"ModbusHost":"h:502","FunctionCode":3,"StartAddress":0,"AddressCount":1}`, "Version 2 is not supported, the current version is 1", 0},
+		{"missing function code", `{"ModbusHost":"h:502"}`, "FunctionCode is required", 0},
+		{"unsupported function code", `{"ModbusHost":"h:502","FunctionCode":9}`, "Invalid FunctionCode", modbus.ExceptionCodeIllegalFunction},
+		{"invalid byte order", `{"ModbusHost":"h:502","FunctionCode":3,"StartAddress":0,"AddressCount":1,"ByteOrder":"abcd"}`, "ByteOrder must be one of ABCD, CDAB, BADC or DCBA", 0},
+		{"missing start address", `{"ModbusHost":"h:502","FunctionCode":3,"AddressCount":1}`, "StartAddress is required", 0},
+		{"missing address count", `{"ModbusHost":"h:502","FunctionCode":3,"StartAddress":0}`, "AddressCount is required", 0},
+		{"zero address count", `{"ModbusHost":"h:502","FunctionCode":1,"StartAddress":0,"AddressCount":0}`, "AddressCount must be between 1 and 2000 for function code 1", modbus.ExceptionCodeIllegalDataValue},
+		{"too many coils", `{"ModbusHost":"h:502","FunctionCode":2,"StartAddress":0,"AddressCount":2001}`, "AddressCount must be between 1 and 2000 for function code 2", modbus.ExceptionCodeIllegalDataValue},
+		{"too many registers", `{"ModbusHost":"h:502","FunctionCode":4,"StartAddress":0,"AddressCount":126}`, "AddressCount must be between 1 and 125 for function code 4", modbus.ExceptionCodeIllegalDataValue},
+		{"beyond last address", `{"ModbusHost":"h:502","FunctionCode":3,"StartAddress":65412,"AddressCount":125}`, "The addresses accessed must be between 0 and 65535", modbus.ExceptionCodeIllegalDataAddress},
+		{"missing write data", `{"ModbusHost":"h:502","FunctionCode":6,"StartAddress":0}`, "Data is required for 'write' function codes", 0},
+		{"invalid coil", `{"ModbusHost":"h:502","FunctionCode":5,"StartAddress":0,"Data":[2]}`, "Data[0] must be a boolean, 0 or 1 for coil writes", modbus.ExceptionCodeIllegalDataValue},
+		{"several coils for function code 5", `{"ModbusHost":"h:502","FunctionCode":5,"StartAddress":0,"Data":[true,false]}`, "Data must contain a single coil value for function code 5", modbus.ExceptionCodeIllegalDataValue},
+		{"coil count mismatch", `{"ModbusHost":"h:502","FunctionCode":15,"StartAddress":0,"AddressCount":3,"Data":[true,false]}`, "AddressCount must match the number of Data values", modbus.ExceptionCodeIllegalDataValue},
+		{"too many coils written", `{"ModbusHost":"h:502","FunctionCode":15,"StartAddress":65535,"Data":[true,false]}`, "The addresses accessed must be between 0 and 65535", modbus.ExceptionCodeIllegalDataAddress},
+		{"register out of range", `{"ModbusHost":"h:502","FunctionCode":6,"StartAddress":0,"Data":[65536]}`, "", modbus.ExceptionCodeIllegalDataValue},
+		{"several registers for function code 6", `{"ModbusHost":"h:502","FunctionCode":6,"StartAddress":0,"Data":[1,2]}`, "Data must contain a single register value for function code 6", modbus.ExceptionCodeIllegalDataValue},
+		{"register count mismatch", `{"ModbusHost":"h:502","FunctionCode":16,"StartAddress":0,"AddressCount":2,"Data":[1,2,3]}`, "AddressCount must match the 3 registers in Data", modbus.ExceptionCodeIllegalDataValue},
+		{"data type for coils", `{"ModbusHost":"h:502","FunctionCode":1,"StartAddress":0,"AddressCount":1,"DataType":"int16"}`, "DataType is only supported for function codes 3, 4, 6, 16 and 23", 0},
+		{"scale for coils", `{"ModbusHost":"h:502","FunctionCode":1,"StartAddress":0,"AddressCount":1,"Scale":2}`, "Scale and Offset are only supported for function codes 3, 4, 6, 16 and 23", 0},
+		{"typed read beyond last register", `{"ModbusHost":"h:502","FunctionCode":3,"StartAddress":65535,"DataType":"float32"}`, "The addresses accessed must be between 0 and 65535", modbus.ExceptionCodeIllegalDataAddress},
+		{"typed read count mismatch", `{"ModbusHost":"h:502","FunctionCode":3,"StartAddress":0,"AddressCount":1,"DataType":"float64"}`, "AddressCount must match the 4 registers of the data types", modbus.ExceptionCodeIllegalDataValue},
+		{"too many typed registers", `{"ModbusHost":"h:502","FunctionCode":3,"StartAddress":0,"DataType":"float64","ValueCount":32}`, "AddressCount must be between 1 and 125 for function code 3", modbus.ExceptionCodeIllegalDataValue},
+
+		//Function code 23 reads and writes separate ranges
+		{"fc23 missing write start address", `{"ModbusHost":"h:502","FunctionCode":23,"StartAddress":0,"AddressCount":1,"Data":[1]}`, "WriteStartAddress is required for function code 23", 0},
+		{"fc23 write beyond last register", `{"ModbusHost":"h:502","FunctionCode":23,"StartAddress":0,"AddressCount":1,"WriteStartAddress":65535,"Data":[1,2]}`, "The registers written must be between address 0 and 65535", modbus.ExceptionCodeIllegalDataAddress},
+		{"fc23 write count mismatch", `{"ModbusHost":"h:502","FunctionCode":23,"StartAddress":0,"AddressCount":1,"WriteStartAddress":0,"WriteAddressCount":3,"Data":[1,2]}`, "WriteAddressCount must match the 2 registers in Data", modbus.ExceptionCodeIllegalDataValue},
+		{"fc23 too many registers written", `{"ModbusHost":"h:502","FunctionCode":23,"StartAddress":0,"AddressCount":4,"WriteStartAddress":0,"DataType":"float64","Data":[1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,20,21,22,23,24,25,26,27,28,29,30,31]}`, "Data exceeds the maximum of 121 registers for function code 23", modbus.ExceptionCodeIllegalDataValue},
+		{"fc23 too many registers read", `{"ModbusHost":"h:502","FunctionCode":23,"StartAddress":0,"AddressCount":126,"WriteStartAddress":0,"Data":[1]}`, "AddressCount must be between 1 and 125 for function code 23", modbus.ExceptionCodeIllegalDataValue},
+
+		{"diagnostics without sub-function", `{"ModbusHost":"h:502","FunctionCode":8}`, "A supported SubFunction is required for function code 8", modbus.ExceptionCodeIllegalFunction},
+		{"diagnostics force listen only", `{"ModbusHost":"h:502","FunctionCode":8,"SubFunction":4}`, "A supported SubFunction is required for function code 8", modbus.ExceptionCodeIllegalFunction},
+		{"diagnostics data out of range", `{"ModbusHost":"h:502","FunctionCode":8,"SubFunction":0,"Data":[65536]}`, "Data must contain a single value between 0 and 65535 for function code 8", modbus.ExceptionCodeIllegalDataValue},
+		{"mask write without masks", `{"ModbusHost":"h:502","FunctionCode":22,"StartAddress":0,"AndMask":255}`, "AndMask and OrMask are required for function code 22 and must be integers between 0 and 65535", 0},
+		{"invalid read device id code", `{"ModbusHost":"h:502","FunctionCode":43,"ReadDeviceIDCode":5}`, "ReadDeviceIDCode must be 1 (basic), 2 (regular), 3 (extended) or 4 (individual)", modbus.ExceptionCodeIllegalDataValue},
+	}
+
+	for _, test := range tests {
+		request, err := decodeRequest([]byte(test.payload))
+		if err != nil {
+			t.Errorf("%s: decodeRequest returned error: %s", test.name, err)
+			continue
+		}
+		err = validateRequest(request)
+		if err == nil {
+			if test.err != "" || test.code != 0 {
+				t.Errorf("%s: validateRequest did not return an error", test.name)
+			}
+			continue
+		}
+		if test.err == "" && test.code == 0 {
+			t.Errorf("%s: validateRequest returned error: %s", test.name, err)
+			continue
+		}
+		if test.err != "" && err.Error() != test.err {
+			t.Errorf("%s: validateRequest error = %q, want %q", test.name, err, test.err)
+		}
+		if code := requestErrorCode(err); code != test.code {
+			t.Errorf("%s: validateRequest error code = %d, want %d", test.name, code, test.code)
+		}
+	}
+}
+
+func TestValidateRequestDerivedCounts(t *testing.T) {
+	tests := []struct {
+		name              string
+		payload           string
+		addressCount      uint16
+		writeAddressCount uint16
+	}{
+		{"typed read", `{"ModbusHost":"h:502","FunctionCode":3,"StartAddress":0,"DataType":"float32","ValueCount":3}`, 6, 0},
+		{"typed read with data types", `{"ModbusHost":"h:502","FunctionCode":4,"StartAddress":0,"DataTypes":["uint16","int64","string:5"]}`, 10, 0},
+		{"typed read with address count", `{"ModbusHost":"h:502","FunctionCode":3,"StartAddress":0,"AddressCount":4,"DataType":"float64"}`, 4, 0},
+		{"typed read with zero address count", `{"ModbusHost":"h:502","FunctionCode":3,"StartAddress":0,"AddressCount":0,"DataType":"float64"}`, 4, 0},
+		{"coil write", `{"ModbusHost":"h:502","FunctionCode":15,"StartAddress":0,"Data":[true,0,1]}`, 3, 0},
+		{"register write", `{"ModbusHost":"h:502","FunctionCode":16,"StartAddress":0,"Data":[1,2,3]}`, 3, 0},
+		{"typed register write", `{"ModbusHost":"h:502","FunctionCode":16,"StartAddress":0,"DataType":"float32","Data":[1.5,2.5]}`, 4, 0},
+		{"fc23 write", `{"ModbusHost":"h:502","FunctionCode":23,"StartAddress":0,"AddressCount":2,"WriteStartAddress":10,"Data":[1,2,3]}`, 2, 3},
+		{"fc23 typed", `{"ModbusHost":"h:502","FunctionCode":23,"StartAddress":0,"WriteStartAddress":10,"DataType":"int32","Data":[7]}`, 2, 2},
+	}
+
+	for _, test := range tests {
+		request, err := decodeRequest([]byte(test.payload))
+		if err != nil {
+			t.Errorf("%s: decodeRequest returned error: %s", test.name, err)
+			continue
+		}
+		if err := validateRequest(request); err != nil {
+			t.Errorf("%s: validateRequest returned error: %s", test.name, err)
+			continue
+		}
+		if request.AddressCount == nil || *request.AddressCount != test.addressCount {
+			t.Errorf("%s: AddressCount = %v, want %d", test.name, request.AddressCount, test.addressCount)
+		}
+		if test.writeAddressCount != 0 && (request.WriteAddressCount == nil || *request.WriteAddressCount != test.writeAddressCount) {
+			t.Errorf("%s: WriteAddressCount = %v, want %d", test.name, request.WriteAddressCount, test.writeAddressCount)
+		}
+	}
+}
+
+func TestValidateAddressRange(t *testing.T) {
+	address := func(value uint16) *uint16 { return &value }
+
+	tests := []struct {
+		functionCode uint16
+		start        uint16
+		count        *uint16
+		code         int
+	}{
+		{modbus.FuncCodeReadCoils, 0, address(2000), 0},
+		{modbus.FuncCodeReadCoils, 63536, address(2000), 0},
+		{modbus.FuncCodeReadCoils, 63537, address(2000), modbus.ExceptionCodeIllegalDataAddress},
+		{modbus.FuncCodeWriteMultipleCoils, 0, address(1968), 0},
+		{modbus.FuncCodeWriteMultipleCoils, 0, address(1969), modbus.ExceptionCodeIllegalDataValue},
+		{modbus.FuncCodeReadHoldingRegisters, 65535, address(1), 0},
+		{modbus.FuncCodeReadHoldingRegisters, 65535, address(2), modbus.ExceptionCodeIllegalDataAddress},
+		{modbus.FuncCodeWriteMultipleRegisters, 0, address(123), 0},
+		{modbus.FuncCodeWriteMultipleRegisters, 0, address(124), modbus.ExceptionCodeIllegalDataValue},
+		{modbus.FuncCodeReadWriteMultipleRegisters, 0, address(125), 0},
+		{modbus.FuncCodeReadInputRegisters, 0, address(0), modbus.ExceptionCodeIllegalDataValue},
+		//Function codes without an address count are not checked
+		{modbus.FuncCodeWriteSingleRegister, 65535, address(0), 0},
+		{modbus.FuncCodeMaskWriteRegister, 65535, address(0), 0},
+	}
+
+	for _, test := range tests {
+		request := &modbusRequest{StartAddress: address(test.start), AddressCount: test.count}
+		err := validateAddressRange(request, test.functionCode)
+		if test.code == 0 && err != nil {
+			t.Errorf("validateAddressRange(%d, %d, %d) returned error: %s", test.functionCode, test.start, *test.count, err)
+		}
+		if test.code != 0 && (err == nil || requestErrorCode(err) != test.code) {
+			t.Errorf("validateAddressRange(%d, %d, %d) = %v, want error code %d", test.functionCode, test.start, *test.count, err, test.code)
+		}
+	}
+
+	request := &modbusRequest{StartAddress: address(0)}
+	if err := validateAddressRange(request, modbus.FuncCodeReadInputRegisters); err == nil || err.Error() != "AddressCount is required" {
+		t.Errorf("validateAddressRange without AddressCount = %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	modbus "github.com/goburrow/modbus"
+	serial "github.com/goburrow/serial"
+)
+
+// How long each read of the serial port waits for data. Responses are read in
+// short reads so that the end of a response of unknown length can be detected
+// without waiting for the whole response timeout.
+const serialReadInterval = 10 * time.Millisecond
+
+// How long the line must be quiet before a response of unknown length is
+// considered complete
+const rtuResponseSilence = 50 * time.Millisecond
+
+// rtuClientHandler sends RTU frames over a serial port. Responses are framed by
+// readRTUFrame, as for rtuOverTCPClientHandler, rather than by the goburrow RTU
+// transporter, which only knows the response length of the standard function
+// codes. The silent interval required between RTU frames is always honoured,
+// even when requests are issued back to back. Encoding and decoding of frames is
+// delegated to the goburrow RTU packager.
+type rtuClientHandler struct {
+	modbus.Packager
+	serial.Config
+
+	IdleTimeout time.Duration
+	Logger      *log.Logger
+
+	mu           sync.Mutex
+	port         io.ReadWriteCloser
+	frameDelay   time.Duration
+	lastFrame    time.Time
+	closeTimer   *time.Timer
+	lastActivity time.Time
+}
+
+func newRTUClientHandler(address string) *rtuClientHandler {
+	return &rtuClientHandler{
+		Packager: modbus.NewRTUClientHandler(""),
+		Config: serial.Config{
+			Address:  address,
+			BaudRate: serialBaudRateDefault,
+			DataBits: serialDataBitsDefault,
+			StopBits: serialStopBitsDefault,
+			Parity:   serialParityDefault,
+			Timeout:  serialTimeout,
+		},
+		IdleTimeout: tcpIdleTimeout,
+		frameDelay:  serialFrameDelay(serialBaudRateDefault),
+	}
+}
+
+// Send writes the RTU frame to the serial port and reads back a single RTU
+// response frame
+func (mb *rtuClientHandler) Send(aduRequest []byte) (aduResponse []byte, err error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if err = mb.connect(); err != nil {
+		return
+	}
+
+	if wait := mb.frameDelay - time.Since(mb.lastFrame); wait > 0 {
+		time.Sleep(wait)
+	}
+	defer func() { mb.lastFrame = time.Now() }()
+
+	mb.lastActivity = time.Now()
+	mb.startCloseTimer()
+
+	var timeout time.Time
+	if mb.Timeout > 0 {
+		timeout = mb.lastActivity.Add(mb.Timeout)
+	}
+
+	mb.logf("modbus: sending % x", aduRequest)
+	if _, err = mb.port.Write(aduRequest); err != nil {
+		return
+	}
+
+	if aduResponse, err = readRTUFrame(mb.readWithin, timeout); err != nil {
+		return
+	}
+	mb.logf("modbus: received % x", aduResponse)
+	return
+}
+
+// readWithin reads from the serial port, waiting at most the specified duration
+// for data. The caller must hold the mutex.
+func (mb *rtuClientHandler) readWithin(buf []byte, wait time.Duration) (int, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		n, err := mb.port.Read(buf)
+		if n > 0 {
+			return n, nil
+		}
+		if err == nil {
+			return 0, io.EOF
+		}
+		if !isReadTimeout(err) || !time.Now().Before(deadline) {
+			return 0, err
+		}
+	}
+}
+
+// readRTUFrame reads a single RTU response frame. The length of the frame is
+// determined from its function code and byte count where possible. Responses
+// whose length cannot be determined, such as responses to raw function codes,
+// end when the line has been silent for rtuResponseSilence. readWithin must
+// return a timeout error when no data arrives within the specified duration. A
+// zero deadline waits indefinitely for the response to begin.
+func readRTUFrame(readWithin func([]byte, time.Duration) (int, error), deadline time.Time) ([]byte, error) {
+	var data [rtuMaxSize]byte
+	n, length := 0, 0
+	for n < rtuMaxSize && (length == 0 || n < length) {
+		//Once the length is known, or cannot be known, only the deadline applies
+		silence := n >= rtuMinSize && length == 0
+		wait := rtuResponseSilence
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return nil, fmt.Errorf("modbus: timed out after reading '%v' bytes of response", n)
+			}
+			if !silence || remaining < wait {
+				wait = remaining
+			}
+		}
+
+		n1, err := readWithin(data[n:], wait)
+		n += n1
+		if err != nil {
+			if !isReadTimeout(err) {
+				return nil, err
+			}
+			if silence {
+				break
+			}
+			if !deadline.IsZero() {
+				return nil, err
+			}
+			continue
+		}
+		length = rtuResponseLength(data[:n])
+	}
+
+	if length > rtuMaxSize {
+		return nil, fmt.Errorf("modbus: response length '%v' must not be bigger than '%v'", length, rtuMaxSize)
+	}
+	if length > 0 && n > length {
+		//Ignore anything received after the end of the frame
+		n = length
+	}
+	return data[:n], nil
+}
+
+// isReadTimeout returns true if a read failed because no data arrived in time
+func isReadTimeout(err error) bool {
+	if err == serial.ErrTimeout {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// Connect opens the serial port
+func (mb *rtuClientHandler) Connect() error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	return mb.connect()
+}
+
+func (mb *rtuClientHandler) connect() error {
+	if mb.port == nil {
+		config := mb.Config
+		config.Timeout = serialReadInterval
+		port, err := serial.Open(&config)
+		if err != nil {
+			return err
+		}
+		mb.port = port
+	}
+	return nil
+}
+
+// Close closes the serial port
+func (mb *rtuClientHandler) Close() error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	return mb.close()
+}
+
+func (mb *rtuClientHandler) close() (err error) {
+	if mb.port != nil {
+		err = mb.port.Close()
+		mb.port = nil
+	}
+	return
+}
+
+func (mb *rtuClientHandler) startCloseTimer() {
+	if mb.IdleTimeout <= 0 {
+		return
+	}
+	if mb.closeTimer == nil {
+		mb.closeTimer = time.AfterFunc(mb.IdleTimeout, mb.closeIdle)
+	} else {
+		mb.closeTimer.Reset(mb.IdleTimeout)
+	}
+}
+
+// closeIdle closes the serial port once it has been idle for IdleTimeout
+func (mb *rtuClientHandler) closeIdle() {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.IdleTimeout <= 0 {
+		return
+	}
+	if idle := time.Since(mb.lastActivity); idle >= mb.IdleTimeout {
+		mb.logf("modbus: closing serial port due to idle timeout: %v", idle)
+		mb.close()
+	}
+}
+
+func (mb *rtuClientHandler) logf(format string, v ...interface{}) {
+	if mb.Logger != nil {
+		mb.Logger.Printf(format, v...)
+	}
+}
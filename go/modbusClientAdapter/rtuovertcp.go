@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	modbus "github.com/goburrow/modbus"
+)
+
+const (
+	rtuMinSize       = 4
+	rtuMaxSize       = 256
+	rtuExceptionSize = 5
+)
+
+// rtuOverTCPClientHandler sends RTU frames (slave id, PDU and CRC) over a raw TCP
+// socket, as expected by serial device servers that forward bytes to an RS-485
+// line unmodified. Framing is delegated to the goburrow RTU packager.
+type rtuOverTCPClientHandler struct {
+	modbus.Packager
+
+	Address     string
+	Timeout     time.Duration
+	IdleTimeout time.Duration
+	Logger      *log.Logger
+
+	mu           sync.Mutex
+	conn         net.Conn
+	closeTimer   *time.Timer
+	lastActivity time.Time
+}
+
+func newRTUOverTCPClientHandler(address string) *rtuOverTCPClientHandler {
+	return &rtuOverTCPClientHandler{
+		Packager:    modbus.NewRTUClientHandler(""),
+		Address:     address,
+		Timeout:     tcpTimeout,
+		IdleTimeout: tcpIdleTimeout,
+	}
+}
+
+// Send writes the RTU frame to the socket and reads back a single RTU response frame
+func (mb *rtuOverTCPClientHandler) Send(aduRequest []byte) (aduResponse []byte, err error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if err = mb.connect(); err != nil {
+		return
+	}
+
+	mb.lastActivity = time.Now()
+	mb.startCloseTimer()
+
+	var timeout time.Time
+	if mb.Timeout > 0 {
+		timeout = mb.lastActivity.Add(mb.Timeout)
+	}
+	if err = mb.conn.SetDeadline(timeout); err != nil {
+		return
+	}
+
+	mb.logf("modbus: sending % x", aduRequest)
+	if _, err = mb.conn.Write(aduRequest); err != nil {
+		return
+	}
+
+	if aduResponse, err = readRTUFrame(mb.readWithin, timeout); err != nil {
+		return
+	}
+	mb.logf("modbus: received % x", aduResponse)
+	return
+}
+
+// readWithin reads from the connection, waiting at most the specified duration
+// for data. The caller must hold the mutex.
+func (mb *rtuOverTCPClientHandler) readWithin(buf []byte, wait time.Duration) (int, error) {
+	if err := mb.conn.SetReadDeadline(time.Now().Add(wait)); err != nil {
+		return 0, err
+	}
+	return mb.conn.Read(buf)
+}
+
+// rtuResponseLength returns the total length of the RTU response frame that
+// begins with the bytes received so far, or 0 if it cannot be determined yet
+func rtuResponseLength(data []byte) int {
+	if len(data) < 3 {
+		return 0
+	}
+
+	functionCode := data[1]
+	if functionCode&0x80 != 0 {
+		return rtuExceptionSize
+	}
+
+	switch functionCode {
+	case modbus.FuncCodeReadCoils,
+		modbus.FuncCodeReadDiscreteInputs,
+		modbus.FuncCodeReadHoldingRegisters,
+		modbus.FuncCodeReadInputRegisters,
+		modbus.FuncCodeReadWriteMultipleRegisters,
+		funcCodeReportServerID,
+		funcCodeReadFileRecord,
+		funcCodeWriteFileRecord:
+		//Slave id, function code, byte count, data, CRC
+		return 3 + int(data[2]) + 2
+	case modbus.FuncCodeWriteSingleCoil,
+		modbus.FuncCodeWriteSingleRegister,
+		modbus.FuncCodeWriteMultipleCoils,
+		modbus.FuncCodeWriteMultipleRegisters,
+		funcCodeDiagnostics:
+		return 8
+	case funcCodeReadExceptionStatus:
+		return 5
+	case modbus.FuncCodeMaskWriteRegister:
+		return 10
+	case modbus.FuncCodeReadFIFOQueue:
+		if len(data) < 4 {
+			return 0
+		}
+		//Slave id, function code, 2 byte count, data, CRC
+		return 4 + int(binary.BigEndian.Uint16(data[2:])) + 2
+	case funcCodeEncapsulatedInterface:
+		return rtuDeviceIDResponseLength(data)
+	}
+	return 0
+}
+
+// rtuDeviceIDResponseLength returns the length of a read device identification
+// response, or 0 if it cannot be determined yet. The response is the slave id,
+// function code, MEI type, read device id code, conformity level, more follows,
+// next object id and number of objects, followed by each object as an id, a
+// length and the value, and the CRC.
+func rtuDeviceIDResponseLength(data []byte) int {
+	if data[2] != meiTypeReadDeviceID || len(data) < 8 {
+		return 0
+	}
+	offset := 8
+	for object := 0; object < int(data[7]); object++ {
+		if len(data) < offset+2 {
+			return 0
+		}
+		offset += 2 + int(data[offset+1])
+	}
+	return offset + 2
+}
+
+// Connect establishes the TCP connection to the device server
+func (mb *rtuOverTCPClientHandler) Connect() error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	return mb.connect()
+}
+
+func (mb *rtuOverTCPClientHandler) connect() error {
+	if mb.conn == nil {
+		dialer := net.Dialer{Timeout: mb.Timeout}
+		conn, err := dialer.Dial("tcp", mb.Address)
+		if err != nil {
+			return err
+		}
+		mb.conn = conn
+	}
+	return nil
+}
+
+// Close closes the TCP connection to the device server
+func (mb *rtuOverTCPClientHandler) Close() error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	return mb.close()
+}
+
+func (mb *rtuOverTCPClientHandler) close() (err error) {
+	if mb.conn != nil {
+		err = mb.conn.Close()
+		mb.conn = nil
+	}
+	return
+}
+
+func (mb *rtuOverTCPClientHandler) startCloseTimer() {
+	if mb.IdleTimeout <= 0 {
+		return
+	}
+	if mb.closeTimer == nil {
+		mb.closeTimer = time.AfterFunc(mb.IdleTimeout, mb.closeIdle)
+	} else {
+		mb.closeTimer.Reset(mb.IdleTimeout)
+	}
+}
+
+// closeIdle closes the connection once it has been idle for IdleTimeout
+func (mb *rtuOverTCPClientHandler) closeIdle() {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.IdleTimeout <= 0 {
+		return
+	}
+	if idle := time.Since(mb.lastActivity); idle >= mb.IdleTimeout {
+		mb.logf("modbus: closing connection due to idle timeout: %v", idle)
+		mb.close()
+	}
+}
+
+func (mb *rtuOverTCPClientHandler) logf(format string, v ...interface{}) {
+	if mb.Logger != nil {
+		mb.Logger.Printf(format, v...)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	modbus "github.com/goburrow/modbus"
+)
+
+// segment is part of a response written by a device server, after a delay
+type segment struct {
+	delay time.Duration
+	data  []byte
+}
+
+// newDeviceServer listens for RTU over TCP connections, answering each request
+// frame with the segments returned by respond. It returns the address of the
+// server and the number of connections it has accepted.
+func newDeviceServer(t *testing.T, respond func(request []byte) []segment) (string, *int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var accepted int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, rtuMaxSize)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					for _, segment := range respond(append([]byte(nil), buf[:n]...)) {
+						time.Sleep(segment.delay)
+						if _, err := conn.Write(segment.data); err != nil {
+							return
+						}
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), &accepted
+}
+
+func newTestRTUOverTCPHandler(t *testing.T, address string) *rtuOverTCPClientHandler {
+	handler := newRTUOverTCPClientHandler(address)
+	handler.Timeout = time.Second
+	handler.IdleTimeout = 0
+	setUnitID(handler, 1)
+	t.Cleanup(func() { handler.Close() })
+	return handler
+}
+
+func TestRTUOverTCPClientHandler(t *testing.T) {
+	address, _ := newDeviceServer(t, func(request []byte) []segment {
+		switch request[1] {
+		case modbus.FuncCodeReadHoldingRegisters:
+			//Split across TCP segments, with a pause longer than the response silence
+			//before the byte count has been received
+			frame := rtuFrame(t, request[1], []byte{4, 0x12, 0x34, 0x56, 0x78})
+			return []segment{{0, frame[:2]}, {2 * rtuResponseSilence, frame[2:5]}, {10 * time.Millisecond, frame[5:]}}
+		case modbus.FuncCodeWriteSingleRegister:
+			return []segment{{0, rtuFrame(t, request[1]|0x80, []byte{2})}}
+		case 65:
+			//A vendor specific function code, framed by silence
+			frame := rtuFrame(t, 65, []byte{1, 2, 3, 4, 5, 6, 7})
+			return []segment{{0, frame[:6]}, {10 * time.Millisecond, frame[6:]}}
+		}
+		return nil
+	})
+	handler := newTestRTUOverTCPHandler(t, address)
+	client := modbus.NewClient(handler)
+
+	results, err := client.ReadHoldingRegisters(100, 2)
+	if err != nil {
+		t.Fatalf("ReadHoldingRegisters returned error: %s", err)
+	}
+	if !bytes.Equal(results, []byte{0x12, 0x34, 0x56, 0x78}) {
+		t.Errorf("ReadHoldingRegisters = % x", results)
+	}
+
+	_, err = client.WriteSingleRegister(1, 2)
+	if modbusErr, ok := err.(*modbus.ModbusError); !ok || modbusErr.ExceptionCode != 2 {
+		t.Errorf("WriteSingleRegister error = %v, want exception 2", err)
+	}
+
+	start := time.Now()
+	response, err := sendRawPDU(handler, 65, []byte{9})
+	if err != nil {
+		t.Fatalf("sendRawPDU returned error: %s", err)
+	}
+	if !bytes.Equal(response, []byte{1, 2, 3, 4, 5, 6, 7}) {
+		t.Errorf("sendRawPDU = % x", response)
+	}
+	if elapsed := time.Since(start); elapsed < rtuResponseSilence {
+		t.Errorf("sendRawPDU returned after %s, before the response silence", elapsed)
+	}
+
+	//The connection is in step with the device after each response
+	if _, err := client.ReadHoldingRegisters(100, 2); err != nil {
+		t.Errorf("ReadHoldingRegisters after the other responses returned error: %s", err)
+	}
+}
+
+func TestRTUOverTCPClientHandlerTimeout(t *testing.T) {
+	address, _ := newDeviceServer(t, func(request []byte) []segment {
+		//A truncated response
+		return []segment{{0, rtuFrame(t, request[1], []byte{4, 0x12, 0x34, 0x56, 0x78})[:5]}}
+	})
+	handler := newTestRTUOverTCPHandler(t, address)
+	handler.Timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	if _, err := modbus.NewClient(handler).ReadHoldingRegisters(0, 2); err == nil {
+		t.Error("ReadHoldingRegisters of a truncated response did not return an error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ReadHoldingRegisters took %s to time out", elapsed)
+	}
+}
+
+func TestRTUOverTCPClientHandlerReconnects(t *testing.T) {
+	address, accepted := newDeviceServer(t, func(request []byte) []segment {
+		return []segment{{0, rtuFrame(t, request[1], []byte{2, 0x00, 0x2A})}}
+	})
+	handler := newTestRTUOverTCPHandler(t, address)
+	handler.IdleTimeout = 50 * time.Millisecond
+	client := modbus.NewClient(handler)
+
+	if _, err := client.ReadHoldingRegisters(0, 1); err != nil {
+		t.Fatalf("ReadHoldingRegisters returned error: %s", err)
+	}
+
+	//The connection is closed once idle, and reopened by the next request
+	time.Sleep(4 * handler.IdleTimeout)
+	handler.mu.Lock()
+	closed := handler.conn == nil
+	handler.mu.Unlock()
+	if !closed {
+		t.Error("the idle connection was not closed")
+	}
+
+	results, err := client.ReadHoldingRegisters(0, 1)
+	if err != nil {
+		t.Fatalf("ReadHoldingRegisters after the idle timeout returned error: %s", err)
+	}
+	if !bytes.Equal(results, []byte{0x00, 0x2A}) {
+		t.Errorf("ReadHoldingRegisters = % x", results)
+	}
+	if count := atomic.LoadInt32(accepted); count != 2 {
+		t.Errorf("the device server accepted %d connection(s), want 2", count)
+	}
+}
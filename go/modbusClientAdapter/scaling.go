@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// engineeringScale converts between the raw values stored in registers and
+// engineering values, where engineering = raw * scale + offset
+type engineeringScale struct {
+	scale     float64
+	offset    float64
+	minValue  float64
+	maxValue  float64
+	precision int //Decimal places of engineering values read, -1 to not round
+}
+
+// isScaled returns true if the request specifies engineering unit scaling
+func isScaled(request *modbusRequest) bool {
+	return request.Scale != nil || request.Offset != nil || request.MinValue != nil ||
+		request.MaxValue != nil || request.Precision != nil
+}
+
+// validateScale validates the engineering unit scaling fields of a request
+func validateScale(request *modbusRequest) error {
+	if request.Scale != nil && *request.Scale == 0 {
+		return fmt.Errorf("Scale must not be 0")
+	}
+	if request.MinValue != nil && request.MaxValue != nil && *request.MinValue > *request.MaxValue {
+		return fmt.Errorf("MinValue must not be greater than MaxValue")
+	}
+	if request.Precision != nil && *request.Precision > 15 {
+		return fmt.Errorf("Precision must be an integer between 0 and 15")
+	}
+	return nil
+}
+
+// requestScale returns the engineering unit scaling of a request. Requests that
+// are not scaled use a scale of 1 and an offset of 0.
+func requestScale(request *modbusRequest) engineeringScale {
+	scale := engineeringScale{
+		scale:     1,
+		minValue:  math.Inf(-1),
+		maxValue:  math.Inf(1),
+		precision: -1,
+	}
+
+	if request.Scale != nil {
+		scale.scale = *request.Scale
+	}
+	if request.Offset != nil {
+		scale.offset = *request.Offset
+	}
+	if request.MinValue != nil {
+		scale.minValue = *request.MinValue
+	}
+	if request.MaxValue != nil {
+		scale.maxValue = *request.MaxValue
+	}
+	if request.Precision != nil {
+		scale.precision = int(*request.Precision)
+	}
+	return scale
+}
+
+// toEngineering converts a raw value read from the device to an engineering
+// value, rounded to the requested precision
+func (s engineeringScale) toEngineering(raw float64) interface{} {
+	value := raw*s.scale + s.offset
+	if s.precision >= 0 {
+		factor := math.Pow(10, float64(s.precision))
+		value = math.Round(value*factor) / factor
+	}
+	return jsonFloat(value)
+}
+
+// rawSnapULPs is the number of units in the last place, of the values a raw value
+// is calculated from, within which the raw value is treated as an exact integer
+// or half
+const rawSnapULPs = 4
+
+// toRaw converts an engineering value to the raw value written to the device.
+// The engineering value is first clamped to MinValue and MaxValue. The raw value
+// is rounded to the nearest integer, with halves rounded away from zero, and
+// clamped to the range of the register type.
+func (s engineeringScale) toRaw(value float64, rawMin float64, rawMax float64) float64 {
+	//Scales such as 0.1 cannot be represented exactly, so 65.55 / 0.1 is
+	//655.4999999999999 rather than 655.5. A quotient within a few units in the
+	//last place of an integer or half is snapped to it before rounding, so that
+	//it rounds as expected without losing the precision of large values.
+	quotient := s.unscale(value)
+	tolerance := rawSnapULPs * (ulp(quotient) + (ulp(s.clamp(value))+ulp(s.offset))/math.Abs(s.scale))
+	if nearest := math.Round(quotient*2) / 2; math.Abs(quotient-nearest) <= tolerance {
+		quotient = nearest
+	}
+	raw := math.Round(quotient)
+	return math.Max(rawMin, math.Min(rawMax, raw))
+}
+
+// unscale converts an engineering value, clamped to MinValue and MaxValue, to an
+// unrounded raw value. It is used directly for floating point registers.
+func (s engineeringScale) unscale(value float64) float64 {
+	return (s.clamp(value) - s.offset) / s.scale
+}
+
+// clamp limits an engineering value to MinValue and MaxValue
+func (s engineeringScale) clamp(value float64) float64 {
+	return math.Max(s.minValue, math.Min(s.maxValue, value))
+}
+
+// ulp returns the distance from the magnitude of a value to the next larger float64
+func ulp(value float64) float64 {
+	value = math.Abs(value)
+	return math.Nextafter(value, math.Inf(1)) - value
+}
+
+// scaleValues converts the numeric values read from the device to engineering
+// values. Strings and bitfields are returned unchanged.
+func scaleValues(values []interface{}, s engineeringScale) []interface{} {
+	scaled := make([]interface{}, len(values))
+	for ndx, value := range values {
+		if raw, ok := numericValue(value); ok {
+			scaled[ndx] = s.toEngineering(raw)
+		} else {
+			scaled[ndx] = value
+		}
+	}
+	return scaled
+}
+
+// scaleRegisters converts 16 bit registers read from the device to engineering values
+func scaleRegisters(registers []uint16, s engineeringScale) []interface{} {
+	scaled := make([]interface{}, len(registers))
+	for ndx, register := range registers {
+		scaled[ndx] = s.toEngineering(float64(register))
+	}
+	return scaled
+}
+
+// unscaleRegisterData converts the engineering values in the Data of a register
+// write to the raw 16 bit register values written to the device
+func unscaleRegisterData(values []interface{}, s engineeringScale) ([]interface{}, error) {
+	raw := make([]interface{}, len(values))
+	for ndx, value := range values {
+		number, ok := value.(float64)
+		if !ok {
+			return nil, fmt.Errorf("Data values must be numbers when the request is scaled")
+		}
+		raw[ndx] = s.toRaw(number, 0, math.MaxUint16)
+	}
+	return raw, nil
+}
+
+// numericValue returns a decoded register value as a float64, and false if the
+// value is not numeric
+func numericValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case uint16:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestEngineeringScaleToRaw(t *testing.T) {
+	unbounded := func(scale float64, offset float64) engineeringScale {
+		return engineeringScale{scale: scale, offset: offset, minValue: math.Inf(-1), maxValue: math.Inf(1), precision: -1}
+	}
+	int64Min, int64Max := dataTypeRange(dataTypeInt64)
+
+	tests := []struct {
+		name   string
+		scale  engineeringScale
+		value  float64
+		rawMin float64
+		rawMax float64
+		want   float64
+	}{
+		{"inexact scale rounds half up", unbounded(0.1, 0), 65.55, 0, math.MaxUint16, 656},
+		{"inexact scale", unbounded(0.1, 0), 65.54, 0, math.MaxUint16, 655},
+		{"exact quotient", unbounded(0.1, 0), 65.5, 0, math.MaxUint16, 655},
+		{"offset cancellation", unbounded(0.1, 100), 100.15, 0, math.MaxUint16, 2},
+		{"inexact value", unbounded(0.01, 0), 1.005, 0, math.MaxUint16, 101},
+		{"half rounds away from zero", unbounded(1, 0), -2.5, math.MinInt16, math.MaxInt16, -3},
+		{"a few ulps below half", unbounded(1, 0), 2.4999999999999996, 0, math.MaxUint16, 3},
+		{"genuinely below half", unbounded(1, 0), 2.49999999999999, 0, math.MaxUint16, 2},
+		{"genuinely below half with inexact scale", unbounded(0.1, 0), 0.2499999999, 0, math.MaxUint16, 2},
+		{"large int64", unbounded(1, 0), 12345678901234567, int64Min, int64Max, 12345678901234568},
+		{"large int64 with offset", unbounded(1, -1000), 12345678901233567, int64Min, int64Max, 12345678901234568},
+		{"large scaled int64", unbounded(0.1, 0), 1234567890123.4, int64Min, int64Max, 12345678901234},
+		{"large scaled int64 half", unbounded(0.1, 0), 1234567890123.45, int64Min, int64Max, 12345678901235},
+		{"clamped to register", unbounded(1, 0), 70000, 0, math.MaxUint16, math.MaxUint16},
+		{"clamped to register minimum", unbounded(1, 0), -1, 0, math.MaxUint16, 0},
+		{"clamped to MaxValue", engineeringScale{scale: 0.1, minValue: 0, maxValue: 100, precision: -1}, 150, 0, math.MaxUint16, 1000},
+		{"clamped to MinValue", engineeringScale{scale: 0.1, minValue: 0, maxValue: 100, precision: -1}, -5, math.MinInt16, math.MaxInt16, 0},
+		{"negative scale", unbounded(-0.5, 10), 9, math.MinInt16, math.MaxInt16, 2},
+	}
+
+	for _, test := range tests {
+		if got := test.scale.toRaw(test.value, test.rawMin, test.rawMax); got != test.want {
+			t.Errorf("%s: toRaw(%v) = %v, want %v", test.name, test.value, got, test.want)
+		}
+	}
+}
+
+func TestEngineeringScaleToEngineering(t *testing.T) {
+	tests := []struct {
+		scale engineeringScale
+		raw   float64
+		want  interface{}
+	}{
+		{engineeringScale{scale: 0.1, precision: -1}, 655, 65.5},
+		{engineeringScale{scale: 0.1, offset: -40, precision: 1}, 653, 25.3},
+		{engineeringScale{scale: 1.0 / 3, precision: 2}, 10, 3.33},
+		{engineeringScale{scale: 2, offset: 1, precision: 0}, 7, 15.0},
+		{engineeringScale{scale: math.MaxFloat64, precision: -1}, 10, nil},
+	}
+
+	for _, test := range tests {
+		if got := test.scale.toEngineering(test.raw); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("toEngineering(%v) with %+v = %#v, want %#v", test.raw, test.scale, got, test.want)
+		}
+	}
+}
+
+func TestScaledRegisterWrite(t *testing.T) {
+	scale := engineeringScale{scale: 1, minValue: math.Inf(-1), maxValue: math.Inf(1), precision: -1}
+	format := registerFormat{byteOrder: byteOrderABCD}
+
+	modbusBytes, err := translateValuesToRegisters([]interface{}{12345678901234567.0}, []string{"int64"}, format, &scale)
+	if err != nil {
+		t.Fatalf("translateValuesToRegisters returned error: %s", err)
+	}
+	if want := []byte{0x00, 0x2B, 0xDC, 0x54, 0x5D, 0x6B, 0x4B, 0x88}; !reflect.DeepEqual(modbusBytes, want) {
+		t.Errorf("translateValuesToRegisters = % x, want % x", modbusBytes, want)
+	}
+
+	scale.scale = 0.1
+	raw, err := unscaleRegisterData([]interface{}{65.55, 0.0, 7000.0}, scale)
+	if err != nil {
+		t.Fatalf("unscaleRegisterData returned error: %s", err)
+	}
+	if want := []interface{}{656.0, 0.0, 65535.0}; !reflect.DeepEqual(raw, want) {
+		t.Errorf("unscaleRegisterData = %v, want %v", raw, want)
+	}
+	if _, err := unscaleRegisterData([]interface{}{"65.55"}, scale); err == nil {
+		t.Error("unscaleRegisterData of a string did not return an error")
+	}
+}
+
+func TestValidateScale(t *testing.T) {
+	float := func(value float64) *float64 { return &value }
+	precision := func(value uint8) *uint8 { return &value }
+
+	tests := []struct {
+		request modbusRequest
+		err     string
+	}{
+		{modbusRequest{Scale: float(0.1), Offset: float(-40)}, ""},
+		{modbusRequest{MinValue: float(0), MaxValue: float(0)}, ""},
+		{modbusRequest{Precision: precision(15)}, ""},
+		{modbusRequest{Scale: float(0)}, "Scale must not be 0"},
+		{modbusRequest{MinValue: float(1), MaxValue: float(0)}, "MinValue must not be greater than MaxValue"},
+		{modbusRequest{Precision: precision(16)}, "Precision must be an integer between 0 and 15"},
+	}
+
+	for _, test := range tests {
+		err := validateScale(&test.request)
+		if (err == nil && test.err != "") || (err != nil && err.Error() != test.err) {
+			t.Errorf("validateScale(%+v) = %v, want %q", test.request, err, test.err)
+		}
+	}
+}
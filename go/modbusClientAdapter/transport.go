@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	modbus "github.com/goburrow/modbus"
+)
+
+const (
+	transportTCP   = "tcp"
+	transportRTU   = "rtu"
+	transportASCII = "ascii"
+	//RTU frames sent over a raw TCP socket, as used by serial device servers
+	transportRTUOverTCP = "rtuovertcp"
+
+	serialTimeout         = 5 * time.Second
+	serialBaudRateDefault = 19200
+	serialDataBitsDefault = 8
+	asciiDataBitsDefault  = 7
+	serialStopBitsDefault = 1
+	serialParityDefault   = "E"
+)
+
+// Error codes reported for serial framing failures. These are outside the range
+// of modbus exception codes so that clients can tell them apart.
+const (
+	errorCodeInvalidFrame = 100
+	errorCodeLRCMismatch  = 101
+	errorCodeCRCMismatch  = 102
+)
+
+// modbusClientHandler is implemented by every goburrow handler the adapter
+// uses, regardless of the underlying transport
+type modbusClientHandler interface {
+	modbus.ClientHandler
+	Connect() error
+	Close() error
+}
+
+// modbusTarget describes a parsed ModbusHost value
+type modbusTarget struct {
+	transport string
+	address   string
+	baudRate  int
+	dataBits  int
+	stopBits  int
+	parity    string
+	timeout   time.Duration
+}
+
+// parseModbusHost converts the ModbusHost value from a request into a modbus target.
+//
+// Plain host:port strings (and tcp:// URLs) select Modbus TCP. Serial devices are
+// addressed with a URL such as rtu:///dev/ttyUSB0?baud=9600&parity=E&stop=1 or,
+// for Modbus ASCII, ascii:///dev/ttyS1?baud=9600. Serial device servers that
+// forward raw RTU frames over TCP are addressed with rtuovertcp://host:port
+func parseModbusHost(host string) (*modbusTarget, error) {
+	if host == "" {
+		return nil, fmt.Errorf("Invalid address for modbus host: %s", host)
+	}
+
+	if !strings.Contains(host, "://") {
+		return &modbusTarget{transport: transportTCP, address: host, timeout: tcpTimeout}, nil
+	}
+
+	hostURL, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid address for modbus host: %s", err.Error())
+	}
+
+	target := &modbusTarget{transport: strings.ToLower(hostURL.Scheme)}
+
+	switch target.transport {
+	case transportTCP, transportRTUOverTCP:
+		target.address = hostURL.Host
+		target.timeout = tcpTimeout
+	case transportRTU, transportASCII:
+		//Allow both rtu:///dev/ttyUSB0 and rtu://COM3 style device names
+		target.address = hostURL.Host + hostURL.Path
+		if err := parseSerialSettings(target, hostURL.Query()); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported modbus transport: %s", hostURL.Scheme)
+	}
+
+	if target.address == "" {
+		return nil, fmt.Errorf("Invalid address for modbus host: %s", host)
+	}
+
+	return target, nil
+}
+
+// key identifies the connection used for the target. Requests with the same key
+// are processed by the same dispatcher worker and share a pooled connection.
+// Serial ports are keyed by device alone, whatever the transport or line settings
+// in the ModbusHost, so that a port is never opened more than once.
+func (target *modbusTarget) key() string {
+	switch target.transport {
+	case transportTCP:
+		return target.address
+	case transportRTU, transportASCII:
+		return "serial://" + target.address
+	}
+	return target.transport + "://" + target.address
+}
+
+// serialFramed returns true if the target frames messages as on a serial line,
+// with the end of a frame determined by its length or by silence, rather than by
+// the MBAP header of modbus TCP
+func (target *modbusTarget) serialFramed() bool {
+	return target.transport != transportTCP
+}
+
+// sameLine returns true if the target uses the same transport and serial line
+// settings as another target with the same key
+func (target *modbusTarget) sameLine(other *modbusTarget) bool {
+	return target.transport == other.transport &&
+		target.baudRate == other.baudRate &&
+		target.dataBits == other.dataBits &&
+		target.stopBits == other.stopBits &&
+		target.parity == other.parity
+}
+
+// modbusHostKey returns the key of the connection used for a ModbusHost. Invalid
+// hosts are keyed by the ModbusHost itself, and fail when they are processed.
+func modbusHostKey(host string) string {
+	target, err := parseModbusHost(host)
+	if err != nil {
+		return host
+	}
+	return target.key()
+}
+
+// parseSerialSettings applies the serial line settings in the query string of a
+// serial ModbusHost URL to the target, using the modbus serial line defaults
+// (19200 baud, 8 data bits for RTU or 7 for ASCII, even parity, 1 stop bit) for
+// anything not specified
+func parseSerialSettings(target *modbusTarget, query url.Values) (err error) {
+	target.baudRate = serialBaudRateDefault
+	target.dataBits = serialDataBitsDefault
+	if target.transport == transportASCII {
+		target.dataBits = asciiDataBitsDefault
+	}
+	target.stopBits = serialStopBitsDefault
+	target.parity = serialParityDefault
+	target.timeout = serialTimeout
+
+	if value := query.Get("baud"); value != "" {
+		if target.baudRate, err = strconv.Atoi(value); err != nil || target.baudRate <= 0 {
+			return fmt.Errorf("Invalid baud rate: %s", value)
+		}
+	}
+
+	if value := query.Get("data"); value != "" {
+		if target.dataBits, err = strconv.Atoi(value); err != nil || (target.dataBits != 7 && target.dataBits != 8) {
+			return fmt.Errorf("Invalid data bits: %s", value)
+		}
+	}
+
+	if value := query.Get("stop"); value != "" {
+		if target.stopBits, err = strconv.Atoi(value); err != nil || (target.stopBits != 1 && target.stopBits != 2) {
+			return fmt.Errorf("Invalid stop bits: %s", value)
+		}
+	}
+
+	if value := query.Get("parity"); value != "" {
+		target.parity = strings.ToUpper(value)
+		if target.parity != "N" && target.parity != "E" && target.parity != "O" {
+			return fmt.Errorf("Invalid parity: %s", value)
+		}
+	}
+
+	if value := query.Get("timeout"); value != "" {
+		if target.timeout, err = time.ParseDuration(value); err != nil || target.timeout <= 0 {
+			return fmt.Errorf("Invalid timeout: %s", value)
+		}
+	}
+
+	return nil
+}
+
+// newModbusHandler creates a handler for the transport selected by the target
+func newModbusHandler(target *modbusTarget) modbusClientHandler {
+	var logger *log.Logger
+	if strings.ToUpper(logLevel) == "DEBUG" {
+		logger = log.New(os.Stdout, "", log.LstdFlags|log.Lshortfile)
+	}
+
+	switch target.transport {
+	case transportRTU:
+		handler := newRTUClientHandler(target.address)
+		handler.BaudRate = target.baudRate
+		handler.DataBits = target.dataBits
+		handler.StopBits = target.stopBits
+		handler.Parity = target.parity
+		handler.Timeout = target.timeout
+		handler.IdleTimeout = tcpIdleTimeout
+		handler.Logger = logger
+		handler.frameDelay = serialFrameDelay(target.baudRate)
+		return handler
+	case transportRTUOverTCP:
+		handler := newRTUOverTCPClientHandler(target.address)
+		handler.Timeout = target.timeout
+		handler.Logger = logger
+		return handler
+	case transportASCII:
+		handler := modbus.NewASCIIClientHandler(target.address)
+		handler.BaudRate = target.baudRate
+		handler.DataBits = target.dataBits
+		handler.StopBits = target.stopBits
+		handler.Parity = target.parity
+		handler.Timeout = target.timeout
+		handler.IdleTimeout = tcpIdleTimeout
+		handler.Logger = logger
+		return handler
+	default:
+		handler := modbus.NewTCPClientHandler(target.address)
+		handler.Timeout = target.timeout
+		handler.IdleTimeout = tcpIdleTimeout
+		handler.Logger = logger
+		return handler
+	}
+}
+
+// defaultUnitID returns the unit id used when a request does not specify one.
+// Modbus TCP servers conventionally ignore unit 0, while unit 0 is the broadcast
+// address on a serial line, so serial transports default to unit 1.
+func defaultUnitID(handler modbusClientHandler) byte {
+	if _, ok := handler.(*modbus.TCPClientHandler); ok {
+		return 0
+	}
+	return 1
+}
+
+// setUnitID sets the unit (slave) id that subsequent requests will be addressed to
+func setUnitID(handler modbusClientHandler, unitID byte) {
+	switch h := handler.(type) {
+	case *modbus.TCPClientHandler:
+		h.SlaveId = unitID
+	case *modbus.ASCIIClientHandler:
+		h.SlaveId = unitID
+	case *rtuClientHandler:
+		h.Packager.(*modbus.RTUClientHandler).SlaveId = unitID
+	case *rtuOverTCPClientHandler:
+		h.Packager.(*modbus.RTUClientHandler).SlaveId = unitID
+	}
+}
+
+// serialFrameDelay returns the 3.5 character silent interval that separates RTU
+// frames. Each character is 11 bits on the wire. Above 19200 baud the modbus
+// serial line specification fixes the interval at 1.75ms.
+func serialFrameDelay(baudRate int) time.Duration {
+	if baudRate <= 0 || baudRate > 19200 {
+		return 1750 * time.Microsecond
+	}
+	return time.Duration(38500000/baudRate) * time.Microsecond
+}
+
+// transportErrorCode maps the framing errors returned by the goburrow RTU and
+// ASCII packagers to adapter error codes. It only applies to serially framed
+// connections, which use those packagers. Any other error maps to 0. goburrow
+// only reports framing errors by their message, which the tests pin to the
+// version of goburrow in use.
+func transportErrorCode(err error) int {
+	if _, ok := err.(hex.InvalidByteError); ok || err == hex.ErrLength {
+		//An ASCII frame that is not valid hex
+		return errorCodeInvalidFrame
+	}
+
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "response lrc"):
+		return errorCodeLRCMismatch
+	case strings.Contains(msg, "response crc"):
+		return errorCodeCRCMismatch
+	case strings.Contains(msg, "response frame"),
+		strings.Contains(msg, "is not an even number"),
+		strings.Contains(msg, "does not meet minimum"):
+		return errorCodeInvalidFrame
+	}
+	return 0
+}
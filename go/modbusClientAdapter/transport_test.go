@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	modbus "github.com/goburrow/modbus"
+)
+
+func TestParseModbusHost(t *testing.T) {
+	tests := []struct {
+		host      string
+		transport string
+		address   string
+		baudRate  int
+		timeout   time.Duration
+		err       string
+	}{
+		{host: "192.168.0.9:502", transport: transportTCP, address: "192.168.0.9:502", timeout: tcpTimeout},
+		{host: "tcp://192.168.0.9:502", transport: transportTCP, address: "192.168.0.9:502", timeout: tcpTimeout},
+		{host: "TCP://192.168.0.9:502", transport: transportTCP, address: "192.168.0.9:502", timeout: tcpTimeout},
+		{host: "rtuovertcp://192.168.0.20:4001", transport: transportRTUOverTCP, address: "192.168.0.20:4001", timeout: tcpTimeout},
+		{host: "rtu:///dev/ttyUSB0", transport: transportRTU, address: "/dev/ttyUSB0", baudRate: 19200, timeout: serialTimeout},
+		{host: "rtu://COM3?baud=9600", transport: transportRTU, address: "COM3", baudRate: 9600, timeout: serialTimeout},
+		{host: "ascii:///dev/ttyS1?timeout=2s", transport: transportASCII, address: "/dev/ttyS1", baudRate: 19200, timeout: 2 * time.Second},
+		{host: "", err: "Invalid address for modbus host: "},
+		{host: "udp://192.168.0.9:502", err: "Unsupported modbus transport: udp"},
+		{host: "rtu://", err: "Invalid address for modbus host: rtu://"},
+		{host: "tcp://", err: "Invalid address for modbus host: tcp://"},
+		{host: "rtu:///dev/ttyUSB0?baud=fast", err: "Invalid baud rate: fast"},
+	}
+
+	for _, test := range tests {
+		target, err := parseModbusHost(test.host)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("parseModbusHost(%q) error = %v, want %q", test.host, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseModbusHost(%q) returned error: %s", test.host, err)
+			continue
+		}
+		if target.transport != test.transport || target.address != test.address ||
+			target.baudRate != test.baudRate || target.timeout != test.timeout {
+			t.Errorf("parseModbusHost(%q) = %+v", test.host, *target)
+		}
+	}
+}
+
+func TestParseSerialSettings(t *testing.T) {
+	tests := []struct {
+		transport string
+		query     string
+		want      modbusTarget
+		err       string
+	}{
+		{transport: transportRTU, query: "", want: modbusTarget{baudRate: 19200, dataBits: 8, stopBits: 1, parity: "E", timeout: 5 * time.Second}},
+		{transport: transportASCII, query: "", want: modbusTarget{baudRate: 19200, dataBits: 7, stopBits: 1, parity: "E", timeout: 5 * time.Second}},
+		{transport: transportRTU, query: "baud=9600&data=7&stop=2&parity=n&timeout=500ms", want: modbusTarget{baudRate: 9600, dataBits: 7, stopBits: 2, parity: "N", timeout: 500 * time.Millisecond}},
+		{transport: transportASCII, query: "data=8&parity=O", want: modbusTarget{baudRate: 19200, dataBits: 8, stopBits: 1, parity: "O", timeout: 5 * time.Second}},
+		{transport: transportRTU, query: "baud=0", err: "Invalid baud rate: 0"},
+		{transport: transportRTU, query: "baud=-9600", err: "Invalid baud rate: -9600"},
+		{transport: transportRTU, query: "baud=9600.5", err: "Invalid baud rate: 9600.5"},
+		{transport: transportRTU, query: "data=6", err: "Invalid data bits: 6"},
+		{transport: transportRTU, query: "data=x", err: "Invalid data bits: x"},
+		{transport: transportRTU, query: "stop=0", err: "Invalid stop bits: 0"},
+		{transport: transportRTU, query: "stop=1.5", err: "Invalid stop bits: 1.5"},
+		{transport: transportRTU, query: "parity=M", err: "Invalid parity: M"},
+		{transport: transportRTU, query: "parity=even", err: "Invalid parity: even"},
+		{transport: transportRTU, query: "timeout=5", err: "Invalid timeout: 5"},
+		{transport: transportRTU, query: "timeout=0s", err: "Invalid timeout: 0s"},
+		{transport: transportRTU, query: "timeout=-1s", err: "Invalid timeout: -1s"},
+	}
+
+	for _, test := range tests {
+		query, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := &modbusTarget{transport: test.transport, address: "/dev/ttyUSB0"}
+		err = parseSerialSettings(target, query)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("parseSerialSettings(%s, %q) error = %v, want %q", test.transport, test.query, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSerialSettings(%s, %q) returned error: %s", test.transport, test.query, err)
+			continue
+		}
+		test.want.transport = test.transport
+		test.want.address = "/dev/ttyUSB0"
+		if *target != test.want {
+			t.Errorf("parseSerialSettings(%s, %q) = %+v, want %+v", test.transport, test.query, *target, test.want)
+		}
+	}
+}
+
+func TestSerialFrameDelay(t *testing.T) {
+	tests := []struct {
+		baudRate int
+		want     time.Duration
+	}{
+		{1200, 32083 * time.Microsecond},
+		{9600, 4010 * time.Microsecond},
+		{19200, 2005 * time.Microsecond},
+		{38400, 1750 * time.Microsecond},
+		{115200, 1750 * time.Microsecond},
+		{0, 1750 * time.Microsecond},
+	}
+
+	for _, test := range tests {
+		if got := serialFrameDelay(test.baudRate); got != test.want {
+			t.Errorf("serialFrameDelay(%d) = %s, want %s", test.baudRate, got, test.want)
+		}
+	}
+}
+
+// pipePort is the adapter end of a net.Pipe standing in for a serial port. Reads
+// give up after serialReadInterval, as reads of an open serial port do.
+type pipePort struct {
+	net.Conn
+}
+
+func (port pipePort) Read(buf []byte) (int, error) {
+	port.SetReadDeadline(time.Now().Add(serialReadInterval))
+	return port.Conn.Read(buf)
+}
+
+// newRTULoopback returns an RTU handler for unit 1 whose serial port is connected
+// to a device that answers each request with the frames returned by respond. The
+// frames are written one at a time, so that a response can be split across
+// several writes.
+func newRTULoopback(t *testing.T, respond func(request []byte) [][]byte) *rtuClientHandler {
+	adapter, device := net.Pipe()
+	t.Cleanup(func() {
+		adapter.Close()
+		device.Close()
+	})
+
+	handler := newRTUClientHandler("loopback")
+	handler.Timeout = time.Second
+	handler.IdleTimeout = 0
+	handler.port = pipePort{adapter}
+	setUnitID(handler, 1)
+
+	go func() {
+		buf := make([]byte, rtuMaxSize)
+		for {
+			n, err := device.Read(buf)
+			if err != nil {
+				return
+			}
+			for _, frame := range respond(buf[:n]) {
+				if _, err := device.Write(frame); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return handler
+}
+
+// rtuFrame returns the RTU frame of a response PDU from unit 1
+func rtuFrame(t *testing.T, functionCode byte, data []byte) []byte {
+	packager := modbus.NewRTUClientHandler("")
+	packager.SlaveId = 1
+	frame, err := packager.Encode(&modbus.ProtocolDataUnit{FunctionCode: functionCode, Data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestRTUClientHandlerLoopback(t *testing.T) {
+	var requests [][]byte
+	handler := newRTULoopback(t, func(request []byte) [][]byte {
+		requests = append(requests, append([]byte(nil), request...))
+		switch request[1] {
+		case modbus.FuncCodeReadHoldingRegisters:
+			//Split the response mid frame
+			frame := rtuFrame(t, request[1], []byte{4, 0x12, 0x34, 0x56, 0x78})
+			return [][]byte{frame[:3], frame[3:6], frame[6:]}
+		case modbus.FuncCodeWriteSingleRegister:
+			return [][]byte{rtuFrame(t, request[1]|0x80, []byte{2})}
+		case 65:
+			//A vendor specific function code, framed by silence
+			return [][]byte{rtuFrame(t, 65, []byte{1, 2, 3, 4, 5, 6, 7})}
+		}
+		return nil
+	})
+	client := modbus.NewClient(handler)
+
+	results, err := client.ReadHoldingRegisters(100, 2)
+	if err != nil {
+		t.Fatalf("ReadHoldingRegisters returned error: %s", err)
+	}
+	if !bytes.Equal(results, []byte{0x12, 0x34, 0x56, 0x78}) {
+		t.Errorf("ReadHoldingRegisters = % x", results)
+	}
+	if want := []byte{1, 3, 0, 100, 0, 2}; !bytes.Equal(requests[0][:6], want) {
+		t.Errorf("request = % x, want % x followed by the crc", requests[0], want)
+	}
+
+	_, err = client.WriteSingleRegister(1, 2)
+	if modbusErr, ok := err.(*modbus.ModbusError); !ok || modbusErr.ExceptionCode != 2 {
+		t.Errorf("WriteSingleRegister error = %v, want exception 2", err)
+	}
+
+	response, err := sendRawPDU(handler, 65, []byte{9})
+	if err != nil {
+		t.Fatalf("sendRawPDU returned error: %s", err)
+	}
+	if !bytes.Equal(response, []byte{1, 2, 3, 4, 5, 6, 7}) {
+		t.Errorf("sendRawPDU = % x", response)
+	}
+}
+
+func TestRTUClientHandlerTimeout(t *testing.T) {
+	handler := newRTULoopback(t, func(request []byte) [][]byte {
+		//A truncated response
+		return [][]byte{rtuFrame(t, request[1], []byte{4, 0x12, 0x34, 0x56, 0x78})[:5]}
+	})
+	handler.Timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	if _, err := modbus.NewClient(handler).ReadHoldingRegisters(0, 2); err == nil {
+		t.Error("ReadHoldingRegisters of a truncated response did not return an error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ReadHoldingRegisters took %s to time out", elapsed)
+	}
+}
+
+// closeRecorder is a pooled handler that records whether it was closed
+type closeRecorder struct {
+	modbusClientHandler
+	closed bool
+}
+
+func (handler *closeRecorder) Close() error {
+	handler.closed = true
+	return nil
+}
+
+var errResponseTimeout = fmt.Errorf("modbus: timed out after reading '0' bytes of response")
+
+func TestRequestFailureCodeDropsConnections(t *testing.T) {
+	defer func(pool *modbusConnectionPool) { modbusPool = pool }(modbusPool)
+
+	tests := []struct {
+		name    string
+		host    string
+		err     error
+		code    int
+		dropped bool
+	}{
+		{"network error", "192.168.0.9:502", &net.OpError{Op: "read", Net: "tcp", Err: errResponseTimeout}, 0, true},
+		{"tcp response error", "192.168.0.9:502", errResponseTimeout, 0, false},
+		{"exception", "rtuovertcp://192.168.0.9:4001", &modbus.ModbusError{FunctionCode: 0x83, ExceptionCode: 2}, 2, false},
+		{"serial timeout", "rtuovertcp://192.168.0.9:4001", errResponseTimeout, 0, true},
+		{"serial crc error", "rtuovertcp://192.168.0.9:4001", fmt.Errorf("modbus: response crc '1' does not match expected '2'"), errorCodeCRCMismatch, true},
+		{"crc message over tcp", "192.168.0.9:502", fmt.Errorf("modbus: response crc '1' does not match expected '2'"), 0, false},
+		{"serial port conflict", "rtu:///dev/ttyUSB0?baud=19200", &portConflictError{address: "/dev/ttyUSB0", host: "rtu:///dev/ttyUSB0?baud=9600"}, 0, false},
+	}
+
+	for _, test := range tests {
+		handler := &closeRecorder{}
+		modbusPool = newModbusConnectionPool(time.Minute)
+		modbusPool.connections[modbusHostKey(test.host)] = &modbusConnection{host: test.host, handler: handler, lastUsed: time.Now()}
+
+		code := requestFailureCode(&modbusRequest{ModbusHost: test.host}, test.err)
+		if code != test.code {
+			t.Errorf("%s: requestFailureCode = %d, want %d", test.name, code, test.code)
+		}
+		_, pooled := modbusPool.connections[modbusHostKey(test.host)]
+		if handler.closed != test.dropped || pooled == test.dropped {
+			t.Errorf("%s: connection closed = %t, pooled = %t, want dropped %t", test.name, handler.closed, pooled, test.dropped)
+		}
+	}
+}
+
+// packagerError returns the error of a packager for a response to a read holding
+// registers request, as returned by exchangePDU
+func packagerError(t *testing.T, packager modbus.Packager, response func(frame []byte) []byte) error {
+	request, err := packager.Encode(&modbus.ProtocolDataUnit{FunctionCode: modbus.FuncCodeReadHoldingRegisters, Data: []byte{0, 0, 0, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//The packagers frame requests and responses alike
+	frame, err := packager.Encode(&modbus.ProtocolDataUnit{FunctionCode: modbus.FuncCodeReadHoldingRegisters, Data: []byte{2, 0x12, 0x34}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aduResponse := response(frame)
+	if err := packager.Verify(request, aduResponse); err != nil {
+		return err
+	}
+	_, err = packager.Decode(aduResponse)
+	return err
+}
+
+func TestTransportErrorCode(t *testing.T) {
+	rtu := modbus.NewRTUClientHandler("")
+	rtu.SlaveId = 1
+	ascii := modbus.NewASCIIClientHandler("")
+	ascii.SlaveId = 1
+	replace := func(offset int, with string) func([]byte) []byte {
+		return func(frame []byte) []byte {
+			if offset < 0 {
+				offset += len(frame)
+			}
+			return append(append(append([]byte(nil), frame[:offset]...), with...), frame[offset+len(with):]...)
+		}
+	}
+
+	//The errors of the goburrow packagers in use, which are only distinguished by
+	//their messages
+	tests := []struct {
+		name     string
+		packager modbus.Packager
+		response func([]byte) []byte
+		code     int
+	}{
+		{"rtu crc", rtu, func(frame []byte) []byte { frame[len(frame)-1] ^= 0xFF; return frame }, errorCodeCRCMismatch},
+		{"rtu short frame", rtu, func(frame []byte) []byte { return frame[:3] }, errorCodeInvalidFrame},
+		{"ascii lrc", ascii, replace(-4, "00"), errorCodeLRCMismatch},
+		{"ascii start", ascii, replace(0, "!"), errorCodeInvalidFrame},
+		{"ascii end", ascii, replace(-2, "\n\n"), errorCodeInvalidFrame},
+		{"ascii odd length", ascii, func(frame []byte) []byte { return append(frame[:7], frame[8:]...) }, errorCodeInvalidFrame},
+		{"ascii short frame", ascii, func(frame []byte) []byte { return []byte(":01\r\n") }, errorCodeInvalidFrame},
+		{"ascii invalid hex", ascii, replace(7, "G"), errorCodeInvalidFrame},
+		{"rtu slave id", rtu, func(frame []byte) []byte { frame[0] = 2; return frame }, 0},
+	}
+
+	for _, test := range tests {
+		err := packagerError(t, test.packager, test.response)
+		if err == nil {
+			t.Errorf("%s: the packager did not return an error", test.name)
+			continue
+		}
+		if code := transportErrorCode(err); code != test.code {
+			t.Errorf("%s: transportErrorCode(%q) = %d, want %d", test.name, err, code, test.code)
+		}
+	}
+
+	if err := packagerError(t, ascii, func(frame []byte) []byte { return frame }); err != nil {
+		t.Errorf("a valid ascii frame returned error: %s", err)
+	}
+	if err := packagerError(t, rtu, func(frame []byte) []byte { return frame }); err != nil {
+		t.Errorf("a valid rtu frame returned error: %s", err)
+	}
+}